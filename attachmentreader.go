@@ -0,0 +1,175 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ErrInvalidAttachmentMAC is returned at the end of a downloaded attachment
+// whose MAC does not match its contents.
+var ErrInvalidAttachmentMAC = errors.New("Invalid MAC on attachment")
+
+// ErrInvalidAttachmentKey is returned for an attachment pointer whose key
+// is not the 32 byte AES-256 key followed by the 32 byte HMAC-SHA256 key.
+var ErrInvalidAttachmentKey = errors.New("Invalid attachment key")
+
+// attachmentKeySize is the size of the combined attachment key.
+const attachmentKeySize = 64
+
+// checkAttachmentKey validates the layout of an attachment pointer's key,
+// so a malformed pointer is rejected before downloading anything.
+func checkAttachmentKey(key []byte) error {
+	if len(key) != attachmentKeySize {
+		return ErrInvalidAttachmentKey
+	}
+	return nil
+}
+
+// attachmentReader decrypts an attachment while it is downloaded, computing its MAC
+// as the ciphertext streams through. The trailing MAC and the last cipher block,
+// which holds the padding, are held back until the end of the stream, where an
+// invalid MAC is returned instead of io.EOF. Callers must discard what they read
+// unless they reach io.EOF.
+type attachmentReader struct {
+	src     io.ReadCloser
+	aesKey  []byte
+	mac     hash.Hash
+	mode    cipher.BlockMode
+	pending []byte // ciphertext not yet decrypted
+	out     []byte // plaintext not yet returned
+	buf     []byte
+	err     error
+}
+
+// newAttachmentReader returns a reader decrypting the attachment read from src
+// with the combined AES-256 and HMAC-SHA256 key, which must have been validated
+// with checkAttachmentKey.
+func newAttachmentReader(src io.ReadCloser, key []byte) io.ReadCloser {
+	return &attachmentReader{
+		src:    src,
+		aesKey: key[:32],
+		mac:    hmac.New(sha256.New, key[32:]),
+		buf:    make([]byte, 32*1024),
+	}
+}
+
+// decrypt authenticates and decrypts the whole blocks of b, starting with the IV.
+func (ar *attachmentReader) decrypt(b []byte) error {
+	if ar.mode == nil {
+		block, err := aes.NewCipher(ar.aesKey)
+		if err != nil {
+			return err
+		}
+		ar.mac.Write(b[:aes.BlockSize])
+		ar.mode = cipher.NewCBCDecrypter(block, b[:aes.BlockSize])
+		b = b[aes.BlockSize:]
+	}
+	ar.mac.Write(b)
+	p := make([]byte, len(b))
+	ar.mode.CryptBlocks(p, b)
+	ar.out = append(ar.out, p...)
+	return nil
+}
+
+// fill reads more ciphertext and decrypts what can be, keeping back the MAC
+// and the last block until the end of the stream.
+func (ar *attachmentReader) fill() error {
+	n, err := ar.src.Read(ar.buf)
+	ar.pending = append(ar.pending, ar.buf[:n]...)
+	if err == io.EOF {
+		return ar.finish()
+	}
+	if err != nil {
+		return err
+	}
+	keep := sha256.Size + aes.BlockSize
+	if ar.mode == nil {
+		keep += aes.BlockSize
+	}
+	if avail := len(ar.pending) - keep; avail >= aes.BlockSize {
+		avail -= avail % aes.BlockSize
+		if ar.mode == nil {
+			// the IV is consumed along with the blocks
+			avail += aes.BlockSize
+		}
+		if err := ar.decrypt(ar.pending[:avail]); err != nil {
+			return err
+		}
+		ar.pending = append(ar.pending[:0], ar.pending[avail:]...)
+	}
+	return nil
+}
+
+// finish processes the rest of the ciphertext once the download completed,
+// checking the MAC and removing the padding.
+func (ar *attachmentReader) finish() error {
+	l := len(ar.pending) - sha256.Size
+	min := aes.BlockSize
+	if ar.mode == nil {
+		min += aes.BlockSize
+	}
+	if l < min || l%aes.BlockSize != 0 {
+		return errors.New("Ciphertext not multiple of AES blocksize")
+	}
+	if err := ar.decrypt(ar.pending[:l]); err != nil {
+		return err
+	}
+	if !hmac.Equal(ar.mac.Sum(nil), ar.pending[l:]) {
+		ar.out = nil
+		return ErrInvalidAttachmentMAC
+	}
+	pad := int(ar.out[len(ar.out)-1])
+	if pad == 0 || pad > aes.BlockSize || pad > len(ar.out) {
+		ar.out = nil
+		return errors.New("Invalid padding on attachment")
+	}
+	ar.out = ar.out[:len(ar.out)-pad]
+	return io.EOF
+}
+
+func (ar *attachmentReader) Read(p []byte) (int, error) {
+	for len(ar.out) == 0 && ar.err == nil {
+		ar.err = ar.fill()
+	}
+	if len(ar.out) > 0 {
+		n := copy(p, ar.out)
+		ar.out = ar.out[n:]
+		return n, nil
+	}
+	return 0, ar.err
+}
+
+func (ar *attachmentReader) Close() error {
+	return ar.src.Close()
+}
+
+// WriteAttachmentFile saves a downloaded attachment to a file as it is read,
+// so large attachments do not need to fit in memory. The file only appears
+// once the whole attachment was read and authenticated; if reading fails,
+// as on a MAC mismatch, the partial file is removed.
+func WriteAttachmentFile(path string, r io.Reader) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".attachment")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -5,21 +5,43 @@ package textsecure
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"mime"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/zmanian/textsecure/protobuf"
 )
 
+// attachmentClient returns the HTTP client for transfers to and from the attachment
+// storage, connecting through the configured proxy like the server connections.
+// The storage is not pinned, its certificate is verified against the system roots.
+func attachmentClient() (*http.Client, error) {
+	dial, err := netDialer()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: &http.Transport{Dial: dial, DisableKeepAlives: true}}, nil
+}
+
 // getAttachment downloads an encrypted attachment blob from the given URL
 func getAttachment(url string) (io.ReadCloser, error) {
+	hc, err := attachmentClient()
+	if err != nil {
+		return nil, err
+	}
 	req, err := http.NewRequest("GET", url, nil)
 	req.Header.Add("Content-type", "application/octet-stream")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := hc.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -27,27 +49,130 @@ func getAttachment(url string) (io.ReadCloser, error) {
 	return resp.Body, nil
 }
 
-// putAttachment uploads an encrypted attachment to the given URL
-func putAttachment(url string, body []byte) error {
+// putAttachment uploads an encrypted attachment to the given URL.
+// Cancelling the context aborts the upload and returns the context's error.
+func putAttachment(ctx context.Context, url string, body []byte) error {
 	br := bytes.NewReader(body)
-	req, err := http.NewRequest("PUT", url, br)
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, br)
 	if err != nil {
 		return err
 	}
-	//req.Header.Add("Content-type", "application/octet-stream")
 	req.Header.Add("Content-type", "application/octet-stream")
 	req.Header.Add("Content-length", strconv.Itoa(len(body)))
-	resp, err := http.DefaultClient.Do(req)
+	hc, err := attachmentClient()
+	if err != nil {
+		return err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	resp.Body.Close()
 
 	if resp.StatusCode >= 300 {
 		return fmt.Errorf("ERROR %d\n", resp.StatusCode)
 	}
+	return nil
+}
+
+// attachmentEncodingParam is the content type parameter marking compressed attachments.
+// Only clients using this package understand it, so compression is opt-in.
+const attachmentEncodingParam = "x-textsecure-encoding"
+
+// compressible reports whether an attachment of the given type is worth compressing.
+func compressible(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mt, "text/") || mt == "application/json" || mt == "application/xml"
+}
+
+// compressAttachment gzips an attachment and marks its content type accordingly.
+func compressAttachment(b []byte, ct string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(b)
+	if err != nil {
+		return nil, "", err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), ct + "; " + attachmentEncodingParam + "=gzip", nil
+}
+
+// decompressAttachment undoes compressAttachment, returning other attachments as they are.
+func decompressAttachment(b []byte, ct string) ([]byte, error) {
+	r, err := decompressReader(ioutil.NopCloser(bytes.NewReader(b)), ct)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// maxDecompressedSize bounds the size of a compressed attachment once inflated,
+// since any sender can mark an attachment as compressed.
+var maxDecompressedSize int64 = 100 << 20
+
+// ErrAttachmentTooLarge is returned when reading a compressed attachment
+// which inflates beyond the maximum attachment size.
+var ErrAttachmentTooLarge = errors.New("Attachment too large once decompressed")
 
-	return err
+// sizeLimitedReader fails with ErrAttachmentTooLarge once more than left bytes are read.
+type sizeLimitedReader struct {
+	r    io.Reader
+	left int64
 }
 
-// uploadAttachment encrypts, authenticates and uploads a given attachment to a location requested from the server
-func uploadAttachment(r io.Reader, ct string) (*att, error) {
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.left {
+		n = int(l.left)
+		l.left = 0
+		return n, ErrAttachmentTooLarge
+	}
+	l.left -= int64(n)
+	return n, err
+}
+
+// decompressReader undoes compressAttachment while the attachment is read,
+// returning readers of other attachments as they are.
+// Reading fails with ErrAttachmentTooLarge past maxDecompressedSize.
+func decompressReader(r io.ReadCloser, ct string) (io.ReadCloser, error) {
+	_, params, err := mime.ParseMediaType(ct)
+	if err != nil || params[attachmentEncodingParam] != "gzip" {
+		return r, nil
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&sizeLimitedReader{gr, maxDecompressedSize}, r}, nil
+}
+
+// UploadAttachment encrypts, authenticates and uploads a given attachment to a location requested from the server.
+// The returned pointer can be sent in several messages without uploading the attachment again.
+// If config.CompressAttachments is set, textual attachments are compressed before encryption.
+func UploadAttachment(r io.Reader, ct string) (*AttachmentPointer, error) {
+	return UploadAttachmentContext(context.Background(), r, ct)
+}
+
+// UploadAttachmentContext is like UploadAttachment, but cancelling the context
+// aborts the upload and returns the context's error, such as context.Canceled.
+func UploadAttachmentContext(ctx context.Context, r io.Reader, ct string) (*AttachmentPointer, error) {
 	//combined AES-256 and HMAC-SHA256 key
 	keys := make([]byte, 64)
 	randBytes(keys)
@@ -57,6 +182,13 @@ func uploadAttachment(r io.Reader, ct string) (*att, error) {
 		return nil, err
 	}
 
+	if conf().CompressAttachments && compressible(ct) {
+		b, ct, err = compressAttachment(b, ct)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	e, err := aesEncrypt(keys[:32], b)
 	if err != nil {
 		return nil, err
@@ -64,58 +196,140 @@ func uploadAttachment(r io.Reader, ct string) (*att, error) {
 
 	m := appendMAC(keys[32:], e)
 
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	id, location, err := allocateAttachment()
 	if err != nil {
 		return nil, err
 	}
-	err = putAttachment(location, m)
+	err = putAttachment(ctx, location, m)
 	if err != nil {
 		return nil, err
 	}
-	return &att{id, ct, keys}, nil
+	return &AttachmentPointer{id, ct, keys}, nil
 }
 
-func handleSingleAttachment(a *textsecure.PushMessageContent_AttachmentPointer) ([]byte, error) {
-	loc, err := getAttachmentLocation(*a.Id)
-	if err != nil {
+// newAttachmentPointer wraps the pointer to a received attachment.
+func newAttachmentPointer(a *textsecure.PushMessageContent_AttachmentPointer) *AttachmentPointer {
+	return &AttachmentPointer{a.GetId(), a.GetContentType(), a.Key}
+}
+
+// attachmentPointers wraps the pointers to the attachments of a received message.
+func attachmentPointers(pmc *textsecure.PushMessageContent) []*AttachmentPointer {
+	var ptrs []*AttachmentPointer
+	for _, a := range pmc.GetAttachments() {
+		ptrs = append(ptrs, newAttachmentPointer(a))
+	}
+	return ptrs
+}
+
+// Download fetches the attachment from the server and returns a reader decrypting it
+// as it is downloaded, so a failed download can be retried on demand. What is read
+// must be discarded unless reading reaches io.EOF, where the MAC is verified;
+// an invalid MAC is returned as ErrInvalidAttachmentMAC instead.
+func (a *AttachmentPointer) Download() (io.ReadCloser, error) {
+	if err := checkAttachmentKey(a.keys); err != nil {
 		return nil, err
 	}
-	r, err := getAttachment(loc)
+	loc, err := getAttachmentLocation(a.id)
 	if err != nil {
 		return nil, err
 	}
-	defer r.Close()
-
-	b, err := ioutil.ReadAll(r)
+	r, err := getAttachment(loc)
 	if err != nil {
 		return nil, err
 	}
+	return decompressReader(newAttachmentReader(r, a.keys), a.ct)
+}
 
-	l := len(b) - 32
-	if !verifyMAC(a.Key[32:], b[:l], b[l:]) {
-		return nil, errors.New("Invalid MAC on attachment")
-	}
-
-	b, err = aesDecrypt(a.Key[:32], b[:l])
+func handleSingleAttachment(a *textsecure.PushMessageContent_AttachmentPointer) ([]byte, error) {
+	r, err := newAttachmentPointer(a).Download()
 	if err != nil {
 		return nil, err
 	}
-	return b, nil
+	defer r.Close()
+	return ioutil.ReadAll(r)
 }
 
-func handleAttachments(pmc *textsecure.PushMessageContent) ([][]byte, error) {
+// handleAttachments downloads the attachments of a message, returning their
+// contents and the pointers to those which were not downloaded, because
+// their content type is not allowed or the download failed.
+func handleAttachments(pmc *textsecure.PushMessageContent) ([][]byte, []*AttachmentPointer) {
 	atts := pmc.GetAttachments()
 	if atts == nil {
 		return nil, nil
 	}
 
-	all := make([][]byte, len(atts))
-	var err error
-	for i, a := range atts {
-		all[i], err = handleSingleAttachment(a)
+	all := [][]byte{}
+	skipped := []*AttachmentPointer{}
+	for _, a := range atts {
+		if !attachmentAllowed(a.GetContentType()) {
+			skipped = append(skipped, newAttachmentPointer(a))
+			continue
+		}
+		b, err := handleSingleAttachment(a)
 		if err != nil {
-			return nil, err
+			// the message is still delivered, the attachment can be downloaded again later
+			log.Printf("Could not download attachment %d: %s\n", a.GetId(), err)
+			skipped = append(skipped, newAttachmentPointer(a))
+			continue
+		}
+		all = append(all, b)
+	}
+	return all, skipped
+}
+
+// attachmentAllowed reports whether an incoming attachment of the given content type
+// may be downloaded, according to the allowed and blocked attachment types in the config.
+func attachmentAllowed(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		mt = strings.ToLower(ct)
+	}
+	if matchContentType(mt, conf().BlockedAttachmentTypes) {
+		return false
+	}
+	return len(conf().AllowedAttachmentTypes) == 0 || matchContentType(mt, conf().AllowedAttachmentTypes)
+}
+
+// matchContentType reports whether a media type matches one of the patterns,
+// which are media types such as "image/png" or wildcards such as "image/*".
+func matchContentType(mt string, patterns []string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == mt || p == "*/*" || (strings.HasSuffix(p, "/*") && strings.HasPrefix(mt, p[:len(p)-1])) {
+			return true
 		}
 	}
-	return all, nil
+	return false
+}
+
+// attachmentsDir returns the directory of the attachments kept in the store.
+func attachmentsDir() string {
+	return filepath.Join(storageDir, "attachments")
+}
+
+// SaveAttachment keeps the contents of an attachment in the store and returns
+// the path to load it from with LoadAttachment. Unless unencryptedStorage is set,
+// it is encrypted at rest like the rest of the store, with the keys derived from
+// the storage password.
+func SaveAttachment(b []byte) (string, error) {
+	err := os.MkdirAll(attachmentsDir(), 0700)
+	if err != nil {
+		return "", err
+	}
+	name := make([]byte, 16)
+	randBytes(name)
+	path := filepath.Join(attachmentsDir(), fmt.Sprintf("%x", name))
+	err = textSecureStore.writeFile(path, b)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// LoadAttachment returns the contents of an attachment saved with SaveAttachment.
+func LoadAttachment(path string) ([]byte, error) {
+	return textSecureStore.readFile(path)
 }
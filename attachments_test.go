@@ -0,0 +1,218 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/zmanian/textsecure/protobuf"
+)
+
+func TestCompressAttachment(t *testing.T) {
+	assert.True(t, compressible("text/plain; charset=utf-8"))
+	assert.False(t, compressible("image/jpeg"))
+
+	b := bytes.Repeat([]byte("hello "), 1000)
+	c, ct, err := compressAttachment(b, "text/plain")
+	assert.NoError(t, err)
+	assert.True(t, len(c) < len(b))
+
+	d, err := decompressAttachment(c, ct)
+	assert.NoError(t, err)
+	assert.Equal(t, b, d)
+
+	d, err = decompressAttachment(b, "text/plain")
+	assert.NoError(t, err)
+	assert.Equal(t, b, d)
+
+	// an attachment inflating beyond the limit is rejected instead of filling memory
+	defer func(max int64) { maxDecompressedSize = max }(maxDecompressedSize)
+	maxDecompressedSize = int64(len(b))
+	_, err = decompressAttachment(c, ct)
+	assert.NoError(t, err, "exactly at the limit")
+	maxDecompressedSize = int64(len(b)) - 1
+	_, err = decompressAttachment(c, ct)
+	assert.Equal(t, ErrAttachmentTooLarge, err)
+}
+
+func TestSaveAttachment(t *testing.T) {
+	defer setupTestStore(t)()
+
+	b := []byte("attachment contents")
+	path, err := SaveAttachment(b)
+	assert.NoError(t, err)
+	raw, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(raw, b), "stored in plaintext")
+
+	d, err := LoadAttachment(path)
+	assert.NoError(t, err)
+	assert.Equal(t, b, d)
+}
+
+func TestPutAttachmentCancel(t *testing.T) {
+	started, done := make(chan bool), make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	assert.Equal(t, context.Canceled, putAttachment(ctx, srv.URL, []byte("data")))
+}
+
+func TestAttachmentReader(t *testing.T) {
+	key := make([]byte, 64)
+	randBytes(key)
+	for _, size := range []int{0, 15, 16, 17, 100000} {
+		b := make([]byte, size)
+		randBytes(b)
+		e, err := aesEncrypt(key[:32], b)
+		assert.NoError(t, err)
+		m := appendMAC(key[32:], e)
+
+		r := newAttachmentReader(ioutil.NopCloser(iotest.HalfReader(bytes.NewReader(m))), key)
+		d, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, b, d)
+
+		m[len(m)/2] ^= 1
+		r = newAttachmentReader(ioutil.NopCloser(bytes.NewReader(m)), key)
+		_, err = ioutil.ReadAll(r)
+		assert.Equal(t, ErrInvalidAttachmentMAC, err)
+	}
+}
+
+func TestAttachmentAllowed(t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+	assert.True(t, attachmentAllowed("application/x-msdownload"))
+
+	config.AllowedAttachmentTypes = []string{"image/*", "text/plain"}
+	config.BlockedAttachmentTypes = []string{"image/svg+xml"}
+	assert.True(t, attachmentAllowed("image/png"))
+	assert.True(t, attachmentAllowed("Image/JPEG"))
+	assert.True(t, attachmentAllowed("text/plain; x-encoding=gzip"))
+	assert.False(t, attachmentAllowed("image/svg+xml"))
+	assert.False(t, attachmentAllowed("text/html"))
+	assert.False(t, attachmentAllowed(""))
+
+	pmc := &textsecure.PushMessageContent{
+		Attachments: []*textsecure.PushMessageContent_AttachmentPointer{{
+			Id:          proto.Uint64(1234),
+			ContentType: proto.String("application/x-msdownload"),
+			Key:         make([]byte, 64),
+		}},
+	}
+	atts, skipped := handleAttachments(pmc)
+	assert.Empty(t, atts)
+	if assert.Len(t, skipped, 1) {
+		assert.Equal(t, "application/x-msdownload", skipped[0].ContentType())
+	}
+}
+
+// downTransport fails every request, as when the server cannot be reached.
+type downTransport struct{}
+
+func (downTransport) get(url string) (*response, error) {
+	return nil, ErrServerUnavailable
+}
+
+func (downTransport) putJSON(url string, body []byte) (*response, error) {
+	return nil, ErrServerUnavailable
+}
+
+func (downTransport) putBinary(url string, body []byte) (*response, error) {
+	return nil, ErrServerUnavailable
+}
+
+func (downTransport) del(url string) (*response, error) {
+	return nil, ErrServerUnavailable
+}
+
+func TestFailedAttachmentDownload(t *testing.T) {
+	config = &Config{}
+	transport = downTransport{}
+	defer func() { config, transport = nil, nil }()
+
+	pmc := &textsecure.PushMessageContent{
+		Body: proto.String("hello"),
+		Attachments: []*textsecure.PushMessageContent_AttachmentPointer{{
+			Id:          proto.Uint64(1234),
+			ContentType: proto.String("image/png"),
+			Key:         make([]byte, 64),
+		}},
+	}
+	b, err := proto.Marshal(pmc)
+	assert.NoError(t, err)
+	msg, err := parseMessageBody("+14155550100", b)
+	assert.NoError(t, err, "the message is delivered without the attachment")
+	assert.Equal(t, "hello", msg.Message())
+	assert.Empty(t, msg.Attachments())
+	assert.Len(t, msg.SkippedAttachments(), 1)
+	if assert.Len(t, msg.AttachmentPointers(), 1) {
+		assert.Equal(t, "image/png", msg.AttachmentPointers()[0].ContentType())
+	}
+
+	_, err = msg.DownloadAttachment(0)
+	assert.Equal(t, ErrServerUnavailable, err)
+	_, err = msg.DownloadAttachment(1)
+	assert.Error(t, err)
+}
+
+func TestCheckAttachmentKey(t *testing.T) {
+	assert.NoError(t, checkAttachmentKey(make([]byte, 64)))
+	for _, size := range []int{0, 32, 63, 65, 96} {
+		assert.Equal(t, ErrInvalidAttachmentKey, checkAttachmentKey(make([]byte, size)))
+	}
+}
+
+func TestWriteAttachmentFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "textsecure")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "attachment")
+
+	assert.Equal(t, ErrInvalidAttachmentMAC, WriteAttachmentFile(path, iotest.DataErrReader(iotest.ErrReader(ErrInvalidAttachmentMAC))))
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, files, "partial file left behind")
+
+	assert.NoError(t, WriteAttachmentFile(path, bytes.NewReader([]byte("hello"))))
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestAttachmentsUseProxy(t *testing.T) {
+	var tunneled []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tunneled = append(tunneled, r.Method+" "+r.Host)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+	config = &Config{Proxy: proxy.URL}
+	defer func() { config = nil }()
+
+	_, err := getAttachment("http://attachments.example.com/1234")
+	assert.Error(t, err)
+	assert.Error(t, putAttachment(context.Background(), "http://attachments.example.com/1234", []byte("x")))
+	assert.Equal(t, []string{"CONNECT attachments.example.com:80", "CONNECT attachments.example.com:80"}, tunneled)
+}
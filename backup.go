@@ -0,0 +1,85 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/zmanian/textsecure/axolotl"
+)
+
+// identityBackupVersion is the format version of identity backups,
+// stored in their first byte so the format can change later.
+const identityBackupVersion = 1
+
+// identityBackupIterations is the PBKDF2 iteration count for the backup key,
+// higher than for the store since backups may end up on untrusted media.
+const identityBackupIterations = 20000
+
+// ErrInvalidIdentityBackup is returned by ImportIdentity for blobs which
+// are not identity backups or were not made with the given password.
+var ErrInvalidIdentityBackup = errors.New("Invalid identity backup or wrong password")
+
+// ExportIdentity returns the identity key pair and registration ID encrypted
+// with the given password, so the identity can be restored with ImportIdentity.
+func ExportIdentity(password string) ([]byte, error) {
+	ikp, err := textSecureStore.GetIdentityKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	regid, err := textSecureStore.GetLocalRegistrationID()
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, 4+64)
+	binary.BigEndian.PutUint32(plaintext, regid)
+	copy(plaintext[4:], ikp.PublicKey.Key()[:])
+	copy(plaintext[36:], ikp.PrivateKey.Key()[:])
+
+	salt := make([]byte, 8)
+	randBytes(salt)
+	s := &store{}
+	s.genKeys(password, salt, identityBackupIterations)
+	e, err := s.encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := append([]byte{identityBackupVersion}, salt...)
+	return append(blob, e...), nil
+}
+
+// identityBackup is the content of an identity backup
+type identityBackup struct {
+	registrationID uint32
+	keyPair        *axolotl.IdentityKeyPair
+}
+
+// restoredIdentity is the identity imported before Setup, used for the registration
+var restoredIdentity *identityBackup
+
+// ImportIdentity decrypts an identity exported with ExportIdentity.
+// It must be called before Setup, which then registers the number with the
+// restored identity instead of a new one, so peers do not see a key change.
+func ImportIdentity(blob []byte, password string) error {
+	if textSecureStore != nil {
+		return errors.New("ImportIdentity must be called before Setup")
+	}
+	if len(blob) < 1+8+32 || blob[0] != identityBackupVersion {
+		return ErrInvalidIdentityBackup
+	}
+	s := &store{}
+	s.genKeys(password, blob[1:9], identityBackupIterations)
+	plaintext, err := s.decrypt(blob[9:])
+	if err != nil || len(plaintext) != 4+64 {
+		return ErrInvalidIdentityBackup
+	}
+	restoredIdentity = &identityBackup{
+		registrationID: binary.BigEndian.Uint32(plaintext),
+		keyPair:        axolotl.NewIdentityKeyPairFromKeys(plaintext[36:], plaintext[4:36]),
+	}
+	return nil
+}
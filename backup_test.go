@@ -0,0 +1,32 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zmanian/textsecure/axolotl"
+)
+
+func TestExportImportIdentity(t *testing.T) {
+	defer setupTestStore(t)()
+
+	ikp := axolotl.GenerateIdentityKeyPair()
+	assert.NoError(t, textSecureStore.SetIdentityKeyPair(ikp))
+	textSecureStore.SetLocalRegistrationID(1234)
+
+	blob, err := ExportIdentity("secret")
+	assert.NoError(t, err)
+
+	assert.Error(t, ImportIdentity(blob, "secret"), "import after Setup")
+	textSecureStore = nil
+	defer func() { restoredIdentity = nil }()
+
+	assert.Equal(t, ErrInvalidIdentityBackup, ImportIdentity(blob, "wrong"))
+	assert.NoError(t, ImportIdentity(blob, "secret"))
+	assert.Equal(t, uint32(1234), restoredIdentity.registrationID)
+	assert.Equal(t, ikp.PublicKey.Key(), restoredIdentity.keyPair.PublicKey.Key())
+	assert.Equal(t, ikp.PrivateKey.Key(), restoredIdentity.keyPair.PrivateKey.Key())
+}
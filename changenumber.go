@@ -0,0 +1,81 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"errors"
+	"log"
+	"strings"
+)
+
+// RequestNumberChangeCode has the server send a verification code to the number
+// the account is moving to, by the given method, "sms" or "voice".
+// An empty method uses the configured verification type.
+func RequestNumberChangeCode(newTel, method string) error {
+	newTel, err := normalizeRecipient(newTel)
+	if err != nil {
+		return err
+	}
+	if method == "" {
+		method = conf().VerificationType
+	}
+	if method == "" {
+		method = "sms"
+	}
+	_, err = requestCode(newTel, method)
+	return err
+}
+
+// ChangeNumber moves the installation to a new number, verified with the code
+// obtained with RequestNumberChangeCode. The identity key, registration ID and
+// sessions are kept, so contacts see the same identity behind the new number,
+// and the local groups list the new number instead of the old one.
+// The server has no change number request, so the new number is registered
+// with our existing keys and the old registration is left to expire.
+// The verification and the upload of prekeys for the new number use their own
+// connection, so the rest of the package keeps using the old number until both
+// succeed, and nothing is changed locally if either fails; after a failed upload
+// ChangeNumber can be retried with a new code. A running ListenForMessages
+// then reconnects as the new number.
+// The tel setting in the config file should be updated by the application;
+// until it is, Setup uses the number the store is registered with.
+func ChangeNumber(newTel, verificationCode string) error {
+	newTel, err := normalizeRecipient(newTel)
+	if err != nil {
+		return err
+	}
+	oldCfg := conf()
+	if newTel == oldCfg.Tel {
+		return errors.New("The account is already registered with this number")
+	}
+
+	// the config is replaced rather than modified, as other goroutines may be reading it
+	newCfg := *oldCfg
+	newCfg.Tel = newTel
+	t := newTransporter(&newCfg)
+	uuid, err := verifyCode(t, strings.Replace(verificationCode, "-", "", -1), "")
+	if err != nil {
+		return err
+	}
+	// the new number starts without prekeys on the server
+	err = refreshPreKeys(t, 0)
+	if err != nil {
+		return err
+	}
+	configMu.Lock()
+	config, transport = &newCfg, t
+	configMu.Unlock()
+	textSecureStore.storeRegisteredTel(newTel)
+	textSecureStore.storeUUID(uuid)
+	registrationInfo.uuid = uuid
+
+	err = renameGroupMember(oldCfg.Tel, newTel)
+	if err != nil {
+		log.Printf("Could not update the groups with the new number: %s\n", err)
+	}
+	// directory lookups were made as the old number
+	resetDirectoryCache()
+	reconnectWebsocket()
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"sync"
+
+	"github.com/zmanian/textsecure/axolotl"
+)
+
+// cipherKey identifies the session with one device of a peer
+type cipherKey struct {
+	recipientID string
+	deviceID    uint32
+}
+
+// ciphers caches the session ciphers in use, so they are not rebuilt
+// for every message. Entries are dropped when the session they belong to
+// is deleted or the peer's identity changes.
+var ciphers = struct {
+	sync.Mutex
+	m map[cipherKey]*axolotl.SessionCipher
+}{m: make(map[cipherKey]*axolotl.SessionCipher)}
+
+// sessionCipher returns the session cipher for the given device of a peer.
+func sessionCipher(recipientID string, deviceID uint32) *axolotl.SessionCipher {
+	ciphers.Lock()
+	defer ciphers.Unlock()
+	k := cipherKey{recipientID, deviceID}
+	sc, ok := ciphers.m[k]
+	// a cipher bound to a previous store, as after a new Setup, is not reused
+	if !ok || sc.SessionStore != axolotl.SessionStore(textSecureStore) {
+		sc = axolotl.NewSessionCipher(textSecureStore, textSecureStore, textSecureStore, textSecureStore, recipientID, deviceID)
+		ciphers.m[k] = sc
+	}
+	return sc
+}
+
+// forgetSessionCipher drops the cached session cipher for the given device of a peer.
+func forgetSessionCipher(recipientID string, deviceID uint32) {
+	ciphers.Lock()
+	defer ciphers.Unlock()
+	delete(ciphers.m, cipherKey{recipientID, deviceID})
+}
+
+// forgetSessionCiphers drops the cached session ciphers for all devices of a peer.
+func forgetSessionCiphers(recipientID string) {
+	ciphers.Lock()
+	defer ciphers.Unlock()
+	for k := range ciphers.m {
+		if k.recipientID == recipientID {
+			delete(ciphers.m, k)
+		}
+	}
+}
+
+// recipientLocks serializes sends to each peer, as encrypting advances
+// the state of the sessions with it.
+var recipientLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+// lockRecipient locks the sessions with a peer and returns the function unlocking them.
+func lockRecipient(recipientID string) func() {
+	recipientLocks.Lock()
+	l, ok := recipientLocks.m[recipientID]
+	if !ok {
+		l = &sync.Mutex{}
+		recipientLocks.m[recipientID] = l
+	}
+	recipientLocks.Unlock()
+	l.Lock()
+	return l.Unlock
+}
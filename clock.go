@@ -0,0 +1,35 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import "time"
+
+// Clock provides the current time and timers. Setting Client.Clock to a fake
+// lets tests drive keepalives, reconnection delays, message age checks,
+// receipt timeouts and prekey rotation without waiting.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+// clock returns the client's clock, or the system clock if none is set.
+func clock() Clock {
+	if client != nil && client.Clock != nil {
+		return client.Clock
+	}
+	return realClock{}
+}
+
+// since returns the time elapsed since t according to the clock.
+func since(t time.Time) time.Duration {
+	return clock().Now().Sub(t)
+}
@@ -200,6 +200,7 @@ func main() {
 		RootDir:             ".",
 		GetVerificationCode: getVerificationCode,
 		GetStoragePassword:  getStoragePassword,
+		ReadLine:            readLine,
 		MessageHandler:      messageHandler,
 	}
 	err := textsecure.Setup(client)
@@ -4,8 +4,15 @@
 package textsecure
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"log"
+	"net/url"
 	"path/filepath"
+	"sync"
 
 	"gopkg.in/yaml.v2"
 )
@@ -17,13 +24,45 @@ var (
 
 // Config holds application configuration settings
 type Config struct {
-	Tel                string `yaml:"tel"`
-	Server             string `yaml:"server"`
-	Fingerprint        string `yaml:"fingerprint"`
-	SkipTLSCheck       bool   `yaml:"skipTLSCheck"`
-	VerificationType   string `yaml:"verificationType"`
-	UnencryptedStorage bool   `yaml:"unencryptedStorage"` // Whether to store plaintext keys and session state (only for development)
-	StoragePassword    string `yaml:"storagePassword"`
+	Tel                    string          `yaml:"tel"`
+	Server                 string          `yaml:"server"`
+	Fingerprint            string          `yaml:"fingerprint"`
+	SkipTLSCheck           bool            `yaml:"skipTLSCheck"`
+	VerificationType       string          `yaml:"verificationType"`
+	UnencryptedStorage     bool            `yaml:"unencryptedStorage"` // Whether to store plaintext keys and session state (only for development)
+	NoFsync                bool            `yaml:"noFsync"`            // Do not fsync store writes, faster but a crash may lose recent keys and sessions
+	StoragePassword        string          `yaml:"storagePassword"`
+	StoragePasswordEnv     string          `yaml:"storagePasswordEnv"`     // Environment variable holding the storage password
+	StoragePasswordFile    string          `yaml:"storagePasswordFile"`    // File whose first line is the storage password
+	StoragePasswordKeyring string          `yaml:"storagePasswordKeyring"` // OS keyring service holding the storage password, with tel as the account
+	IdleTimeout            int             `yaml:"idleTimeout"`            // Seconds without incoming messages before ListenForMessages disconnects, 0 means never
+	TLSMinVersion          string          `yaml:"tlsMinVersion"`          // Minimum TLS version such as "1.2", defaults to the crypto/tls default
+	CipherSuites           []string        `yaml:"cipherSuites"`           // Allowed TLS cipher suite names as listed by crypto/tls, defaults to all
+	PinPosition            string          `yaml:"pinPosition"`            // Which certificate the fingerprint pins: "leaf" (default), "ca" or "any"
+	ForceRegistration      bool            `yaml:"forceRegistration"`      // Register again a number already registered from this installation
+	DefaultCountryCode     string          `yaml:"defaultCountryCode"`     // Country code for recipient numbers given without a leading +
+	AllowInsecure          bool            `yaml:"allowInsecure"`          // Must be set for skipTLSCheck or unencryptedStorage to take effect
+	MaxMessageLength       int             `yaml:"maxMessageLength"`       // Maximum message body size in bytes, defaults to 2000
+	SplitLongMessages      bool            `yaml:"splitLongMessages"`      // Send over-long messages as several messages instead of failing
+	RecoverFromPanics      bool            `yaml:"recoverFromPanics"`      // Turn panics while handling a received message into errors instead of crashing
+	Environment            string          `yaml:"environment"`            // Server preset, "staging" or "production", whose settings server and fingerprint override
+	MaxMessageAge          int             `yaml:"maxMessageAge"`          // Seconds after which received messages are dropped instead of handled, 0 means never
+	IgnoreUnknownEnvelopes bool            `yaml:"ignoreUnknownEnvelopes"` // Acknowledge and skip envelopes of unknown types instead of failing on them
+	DirectoryCacheTTL      int             `yaml:"directoryCacheTTL"`      // Seconds directory lookups of contacts are cached, defaults to an hour
+	PreKeyBatchSize        int             `yaml:"preKeyBatchSize"`        // One-time prekeys generated and kept on the server, defaults to 100
+	MaxDecryptionFailures  int             `yaml:"maxDecryptionFailures"`  // Consecutive decryption failures from a peer device before its session is reset, 0 to never reset
+	TrackReadState         bool            `yaml:"trackReadState"`         // Remember received messages until the client marks them read
+	SendSyncTranscripts    bool            `yaml:"sendSyncTranscripts"`    // Send a copy of every sent message to our linked devices
+	MaxReconnectAttempts   int             `yaml:"maxReconnectAttempts"`   // Consecutive failed websocket reconnections before ListenForMessages gives up, 0 to retry forever
+	Capabilities           map[string]bool `yaml:"capabilities"`           // Capabilities advertised to the server in the account attributes
+	Undiscoverable         bool            `yaml:"undiscoverable"`         // Do not let others find the account by looking up its phone number
+	Proxy                  string          `yaml:"proxy"`                  // Proxy URL for the connections to the server, socks5://host:port or http://host:port
+	AlternateHosts         []AlternateHost `yaml:"alternateHosts"`         // Fronted hosts tried in order when the server cannot be reached
+	Endpoints              *Endpoints      `yaml:"endpoints"`              // Server API paths overriding DefaultEndpoints, for custom deployments
+	CompressAttachments    bool            `yaml:"compressAttachments"`    // Gzip textual attachments, only understood by clients using this package
+	AllowedAttachmentTypes []string        `yaml:"allowedAttachmentTypes"` // Content types of incoming attachments to download, such as "image/*", defaults to all
+	BlockedAttachmentTypes []string        `yaml:"blockedAttachmentTypes"` // Content types of incoming attachments never downloaded, even if allowed
+	SendConcurrency        int             `yaml:"sendConcurrency"`        // Group members a message is sent to in parallel, defaults to 4
 }
 
 // readConfig reads a YAML config file
@@ -41,16 +80,162 @@ func readConfig(fileName string) (*Config, error) {
 	return cfg, nil
 }
 
+// Validate checks that the required settings are present and well formed,
+// returning an error naming the offending setting.
+// It also warns about settings which weaken security.
+func (c *Config) Validate() error {
+	if c.Tel == "" {
+		return errors.New("config: tel is required")
+	}
+	if _, err := normalizeTel(c.Tel, ""); err != nil {
+		return fmt.Errorf("config: tel %q is not in E.164 format", c.Tel)
+	}
+	if c.Server == "" {
+		return errors.New("config: server is required")
+	}
+	u, err := url.Parse(c.Server)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("config: server %q is not a valid http(s) URL", c.Server)
+	}
+	if u.Scheme == "https" {
+		fp, err := hex.DecodeString(c.Fingerprint)
+		if err != nil || len(fp) != sha256.Size {
+			return fmt.Errorf("config: fingerprint must be the hex encoded SHA256 hash of the server's public key (%d hex digits)", 2*sha256.Size)
+		}
+	}
+	for i, a := range c.AlternateHosts {
+		fp, err := hex.DecodeString(a.Fingerprint)
+		if a.Front == "" || err != nil || len(fp) != sha256.Size {
+			return fmt.Errorf("config: alternateHosts[%d] needs a front and the fingerprint of its public key", i)
+		}
+	}
+	if c.Proxy != "" {
+		p, err := url.Parse(c.Proxy)
+		if err != nil || (p.Scheme != "socks5" && p.Scheme != "socks5h" && p.Scheme != "http") || p.Host == "" {
+			return fmt.Errorf("config: proxy %q is not a valid socks5 or http URL", c.Proxy)
+		}
+	}
+	if c.TLSMinVersion != "" {
+		if _, ok := tlsVersions[c.TLSMinVersion]; !ok {
+			return fmt.Errorf("config: tlsMinVersion %q is not one of 1.0, 1.1, 1.2, 1.3", c.TLSMinVersion)
+		}
+	}
+	for _, name := range c.CipherSuites {
+		if _, err := cipherSuiteID(name); err != nil {
+			return fmt.Errorf("config: cipherSuites: %s", err)
+		}
+	}
+	switch c.PinPosition {
+	case "", "any", "leaf", "ca":
+	default:
+		return fmt.Errorf("config: pinPosition %q is not one of leaf, ca, any", c.PinPosition)
+	}
+	if c.SkipTLSCheck && (c.PinPosition == "ca" || c.PinPosition == "any") {
+		// without verification the CA certificates are whatever the server chose to present
+		return errors.New("config: pinPosition ca and any require the certificate chain to be verified, unset skipTLSCheck")
+	}
+	if c.VerificationType != "" && c.VerificationType != "sms" && c.VerificationType != "voice" && c.VerificationType != "dev" {
+		return fmt.Errorf("config: verificationType %q is not one of sms, voice, dev", c.VerificationType)
+	}
+	if c.IdleTimeout < 0 {
+		return errors.New("config: idleTimeout cannot be negative")
+	}
+	if c.MaxMessageAge < 0 {
+		return errors.New("config: maxMessageAge cannot be negative")
+	}
+	if c.MaxMessageLength < 0 {
+		return errors.New("config: maxMessageLength cannot be negative")
+	}
+	if c.DirectoryCacheTTL < 0 {
+		return errors.New("config: directoryCacheTTL cannot be negative")
+	}
+	if c.MaxReconnectAttempts < 0 {
+		return errors.New("config: maxReconnectAttempts cannot be negative")
+	}
+	if c.PreKeyBatchSize < 0 || c.PreKeyBatchSize > maxPreKeyBatchSize {
+		return fmt.Errorf("config: preKeyBatchSize must be between 0 and %d", maxPreKeyBatchSize)
+	}
+	if c.MaxDecryptionFailures < 0 {
+		return errors.New("config: maxDecryptionFailures cannot be negative")
+	}
+	if c.SendConcurrency < 0 {
+		return errors.New("config: sendConcurrency cannot be negative")
+	}
+
+	if (c.SkipTLSCheck || c.UnencryptedStorage) && !c.AllowInsecure {
+		return errors.New("config: skipTLSCheck and unencryptedStorage require allowInsecure to be set")
+	}
+	if c.SkipTLSCheck {
+		log.Println("WARNING: skipTLSCheck is set, the server certificate chain is not verified and only the pinned fingerprint protects the connection")
+	}
+	if c.UnencryptedStorage {
+		log.Println("WARNING: unencryptedStorage is set, keys and session state are stored in plaintext")
+	}
+	return nil
+}
+
 func loadConfig() (*Config, error) {
+	var cfg *Config
+	var err error
 	if client.GetConfig != nil {
-		return client.GetConfig()
+		cfg, err = client.GetConfig()
+	} else {
+		configDir = filepath.Join(client.RootDir, ".config")
+		configFile = filepath.Join(configDir, "config.yml")
+		cfg, err = readConfig(configFile)
 	}
-
-	configDir = filepath.Join(client.RootDir, ".config")
-	configFile = filepath.Join(configDir, "config.yml")
-	config, err := readConfig(configFile)
 	if err != nil {
 		return nil, err
 	}
-	return config, nil
+	err = cfg.applyEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configMu guards config and transport, which ReloadConfig replaces
+// while other goroutines are sending and receiving.
+var configMu sync.RWMutex
+
+// conf returns the current configuration.
+func conf() *Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+// setConfig replaces the current configuration.
+func setConfig(cfg *Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	config = cfg
+}
+
+// ReloadConfig reads the configuration again and applies the settings which can be
+// changed while running, such as the idle timeout and the TLS and pinning settings.
+// It fails without applying anything if a setting which needs a restart was changed.
+// Connection settings such as the server, endpoints, proxy and pinning apply to new
+// connections: an open websocket keeps its settings until ListenForMessages reconnects.
+func ReloadConfig() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cur := conf()
+	if cfg.Tel != cur.Tel {
+		return errors.New("Cannot change tel while running, a new registration is needed")
+	}
+	if cfg.UnencryptedStorage != cur.UnencryptedStorage || cfg.StoragePassword != cur.StoragePassword ||
+		cfg.StoragePasswordEnv != cur.StoragePasswordEnv || cfg.StoragePasswordFile != cur.StoragePasswordFile ||
+		cfg.StoragePasswordKeyring != cur.StoragePasswordKeyring || cfg.NoFsync != cur.NoFsync {
+		return errors.New("Cannot change the storage settings while running")
+	}
+	setConfig(cfg)
+	setupTransporter()
+	return nil
 }
@@ -0,0 +1,94 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func validConfig() *Config {
+	return &Config{
+		Tel:         "+14155550100",
+		Server:      stagingServer,
+		Fingerprint: "e221a8c5ad8198c89b06cd5a3995517b69ec0a9b23f0c00cc9a02fb72a612e7e",
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, validConfig().Validate())
+
+	insecure := validConfig()
+	insecure.SkipTLSCheck = true
+	insecure.AllowInsecure = true
+	assert.NoError(t, insecure.Validate())
+
+	invalid := map[string]func(*Config){
+		"tel":              func(c *Config) { c.Tel = "" },
+		"E.164":            func(c *Config) { c.Tel = "4155550100" },
+		"server":           func(c *Config) { c.Server = "" },
+		"fingerprint":      func(c *Config) { c.Fingerprint = "e221a8" },
+		"tlsMinVersion":    func(c *Config) { c.TLSMinVersion = "2.0" },
+		"pinPosition":      func(c *Config) { c.PinPosition = "root" },
+		"pinPosition ca":   func(c *Config) { c.PinPosition, c.SkipTLSCheck, c.AllowInsecure = "ca", true, true },
+		"verificationType": func(c *Config) { c.VerificationType = "fax" },
+		"proxy":            func(c *Config) { c.Proxy = "ftp://proxy.example.com" },
+		"preKeyBatchSize":  func(c *Config) { c.PreKeyBatchSize = maxPreKeyBatchSize + 1 },
+		"sendConcurrency":  func(c *Config) { c.SendConcurrency = -1 },
+		"alternateHosts":   func(c *Config) { c.AlternateHosts = []AlternateHost{{Front: "front.example.com"}} },
+		"allowInsecure":    func(c *Config) { c.SkipTLSCheck = true },
+	}
+	for field, modify := range invalid {
+		c := validConfig()
+		modify(c)
+		err := c.Validate()
+		if assert.Error(t, err, field) {
+			assert.True(t, strings.Contains(err.Error(), field), "error %q should name %s", err, field)
+		}
+	}
+}
+
+func TestConfigApplyEnvironment(t *testing.T) {
+	c := &Config{Tel: "+14155550100", Environment: "staging"}
+	assert.NoError(t, c.applyEnvironment())
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, stagingServer, c.Server)
+	assert.True(t, c.rawWebsocketBodies())
+
+	c = &Config{Environment: "staging", Server: "https://example.org"}
+	assert.NoError(t, c.applyEnvironment())
+	assert.Equal(t, "https://example.org", c.Server)
+	assert.False(t, c.rawWebsocketBodies())
+
+	c = &Config{Environment: "test"}
+	assert.Error(t, c.applyEnvironment())
+}
+
+func TestReloadConfig(t *testing.T) {
+	next := validConfig()
+	config, client = validConfig(), &Client{GetConfig: func() (*Config, error) { return next, nil }}
+	defer func() { config, client, transport = nil, nil, nil }()
+
+	// requests in flight read the settings while they are replaced
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = conf().IdleTimeout
+			_ = currentTransport()
+		}
+	}()
+	next.IdleTimeout = 60
+	assert.NoError(t, ReloadConfig())
+	<-done
+	assert.Equal(t, 60, conf().IdleTimeout)
+	assert.NotNil(t, currentTransport())
+
+	next = validConfig()
+	next.NoFsync = true
+	assert.Error(t, ReloadConfig(), "storage settings need a restart")
+	assert.Equal(t, 60, conf().IdleTimeout, "nothing is applied")
+}
@@ -47,7 +47,10 @@ func verifyMAC(key, b, mac []byte) bool {
 	return hmac.Equal(m.Sum(nil), mac)
 }
 
-// telToToken calculates a truncated SHA1 hash of a phone number, to be used for contact discovery
+// telToToken calculates a truncated SHA1 hash of a phone number, to be used for contact discovery.
+// Only these tokens are sent to the directory service, never the numbers themselves;
+// the server matches them against the tokens of registered users, which is the
+// scheme it expects, so switching the hash would break discovery.
 func telToToken(tel string) string {
 	s := sha1.Sum([]byte(tel))
 	return base64EncWithoutPadding(s[:10])
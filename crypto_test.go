@@ -17,3 +17,9 @@ func TestMAC(t *testing.T) {
 	macced := appendMAC(key, msg)
 	assert.True(t, verifyMAC(key, macced[:100], macced[100:]))
 }
+
+func TestTelToToken(t *testing.T) {
+	// base64 of the first 10 bytes of SHA1("+14155550100"), without padding
+	assert.Equal(t, "Bp4XXivfryd55A", telToToken("+14155550100"))
+	assert.NotEqual(t, telToToken("+14155550100"), telToToken("+14155550101"))
+}
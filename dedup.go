@@ -0,0 +1,69 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"sync"
+
+	"github.com/zmanian/textsecure/protobuf"
+)
+
+// envelopeKey identifies a received envelope, so one redelivered by the
+// server before it was acknowledged is not processed twice.
+type envelopeKey struct {
+	source    string
+	device    uint32
+	timestamp uint64
+	preKeyID  uint32
+}
+
+func newEnvelopeKey(ipms *textsecure.IncomingPushMessageSignal, preKeyID uint32) envelopeKey {
+	return envelopeKey{
+		source:    ipms.GetSource(),
+		device:    ipms.GetSourceDevice(),
+		timestamp: ipms.GetTimestamp(),
+		preKeyID:  preKeyID,
+	}
+}
+
+// dedupCacheSize is how many recently decrypted envelopes are remembered
+const dedupCacheSize = 1000
+
+// dedupCache remembers a bounded number of keys, forgetting the oldest first.
+type dedupCache struct {
+	sync.Mutex
+	size  int
+	seen  map[envelopeKey]bool
+	order []envelopeKey
+}
+
+func newDedupCache(size int) *dedupCache {
+	return &dedupCache{
+		size: size,
+		seen: make(map[envelopeKey]bool),
+	}
+}
+
+func (c *dedupCache) contains(k envelopeKey) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.seen[k]
+}
+
+func (c *dedupCache) add(k envelopeKey) {
+	c.Lock()
+	defer c.Unlock()
+	if c.seen[k] {
+		return
+	}
+	if len(c.order) == c.size {
+		delete(c.seen, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.seen[k] = true
+	c.order = append(c.order, k)
+}
+
+// receivedEnvelopes holds the envelopes decrypted recently
+var receivedEnvelopes = newDedupCache(dedupCacheSize)
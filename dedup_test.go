@@ -0,0 +1,25 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupCache(t *testing.T) {
+	c := newDedupCache(2)
+	k1 := envelopeKey{source: "+14155550100", device: 1, timestamp: 1, preKeyID: 7}
+	k2 := envelopeKey{source: "+14155550100", device: 1, timestamp: 2}
+	k3 := envelopeKey{source: "+14155550100", device: 1, timestamp: 3}
+	c.add(k1)
+	assert.True(t, c.contains(k1))
+	assert.False(t, c.contains(envelopeKey{source: "+14155550100", device: 1, timestamp: 1, preKeyID: 8}))
+	c.add(k2)
+	c.add(k3)
+	assert.False(t, c.contains(k1))
+	assert.True(t, c.contains(k2))
+	assert.True(t, c.contains(k3))
+}
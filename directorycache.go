@@ -0,0 +1,87 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultDirectoryCacheTTL is how long directory lookups are cached
+// unless the config says otherwise.
+const defaultDirectoryCacheTTL = time.Hour
+
+func directoryCacheTTL() time.Duration {
+	if conf().DirectoryCacheTTL > 0 {
+		return time.Duration(conf().DirectoryCacheTTL) * time.Second
+	}
+	return defaultDirectoryCacheTTL
+}
+
+// directoryEntry is the result of looking up a contact token in the directory.
+type directoryEntry struct {
+	contact *jsonContact // nil if the contact is not registered
+	checked time.Time
+}
+
+// directoryCache remembers which contact tokens the directory reported as
+// registered or not, since directory requests are expensive and rate limited.
+var directoryCache = struct {
+	sync.Mutex
+	entries map[string]directoryEntry
+}{entries: make(map[string]directoryEntry)}
+
+// resetDirectoryCache forgets all directory lookups, as when the account changes.
+func resetDirectoryCache() {
+	directoryCache.Lock()
+	defer directoryCache.Unlock()
+	directoryCache.entries = make(map[string]directoryEntry)
+}
+
+// cachedIntersectContacts is like intersectContacts, but answers from the cache
+// for the tokens looked up less than the cache TTL ago, unless force is set.
+// The cache is not locked during the directory request, so concurrent callers
+// missing the same tokens may each look them up.
+func cachedIntersectContacts(tokens []string, force bool) ([]jsonContact, error) {
+	ttl := directoryCacheTTL()
+	jc := []jsonContact{}
+	missing := []string{}
+	directoryCache.Lock()
+	for _, t := range tokens {
+		e, ok := directoryCache.entries[t]
+		if force || !ok || since(e.checked) >= ttl {
+			missing = append(missing, t)
+			continue
+		}
+		if e.contact != nil {
+			jc = append(jc, *e.contact)
+		}
+	}
+	directoryCache.Unlock()
+	if len(missing) == 0 {
+		return jc, nil
+	}
+
+	found, err := intersectContacts(missing)
+	if err != nil {
+		return nil, err
+	}
+	now := clock().Now()
+	directoryCache.Lock()
+	defer directoryCache.Unlock()
+	// expired entries are dropped, so contacts removed locally do not stay cached forever
+	for t, e := range directoryCache.entries {
+		if since(e.checked) >= ttl {
+			delete(directoryCache.entries, t)
+		}
+	}
+	for _, t := range missing {
+		directoryCache.entries[t] = directoryEntry{checked: now}
+	}
+	for i := range found {
+		directoryCache.entries[found[i].Token] = directoryEntry{&found[i], now}
+		jc = append(jc, found[i])
+	}
+	return jc, nil
+}
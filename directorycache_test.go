@@ -0,0 +1,76 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zmanian/textsecure/internal/testutil"
+)
+
+// directoryTransport answers directory requests with the registered tokens,
+// counting how many tokens it was asked about.
+type directoryTransport struct {
+	okTransport
+	registered map[string]bool
+	queried    int
+}
+
+func (dt *directoryTransport) putJSON(url string, body []byte) (*response, error) {
+	var req map[string][]string
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	found := []jsonContact{}
+	for _, t := range req["contacts"] {
+		dt.queried++
+		if dt.registered[t] {
+			found = append(found, jsonContact{Token: t})
+		}
+	}
+	b, _ := json.Marshal(map[string][]jsonContact{"contacts": found})
+	return &response{Status: 200, Body: ioutil.NopCloser(bytes.NewReader(b))}, nil
+}
+
+func TestDirectoryCache(t *testing.T) {
+	contacts := []Contact{{"Alice", "+14155550130"}, {"Bob", "+14155550131"}}
+	dt := &directoryTransport{registered: map[string]bool{telToToken("+14155550130"): true}}
+	clk := testutil.NewClock(time.Unix(1420070400, 0))
+	config, transport = &Config{}, dt
+	client = &Client{
+		Clock:            clk,
+		GetLocalContacts: func() ([]Contact, error) { return contacts, nil },
+	}
+	resetDirectoryCache()
+	defer func() { config, client, transport = nil, nil, nil }()
+
+	for i := 0; i < 2; i++ {
+		lc, err := GetRegisteredContacts()
+		assert.NoError(t, err)
+		assert.Equal(t, []Contact{contacts[0]}, lc)
+	}
+	assert.Equal(t, 2, dt.queried, "the second lookup is answered from the cache")
+
+	lc, err := RefreshRegisteredContacts()
+	assert.NoError(t, err)
+	assert.Equal(t, []Contact{contacts[0]}, lc)
+	assert.Equal(t, 4, dt.queried)
+
+	clk.Advance(defaultDirectoryCacheTTL)
+	dt.registered[telToToken("+14155550131")] = true
+	lc, err = GetRegisteredContacts()
+	assert.NoError(t, err)
+	assert.Len(t, lc, 2)
+	assert.Equal(t, 6, dt.queried, "expired entries are looked up again")
+
+	clk.Advance(defaultDirectoryCacheTTL)
+	_, err = cachedIntersectContacts([]string{telToToken("+14155550130")}, false)
+	assert.NoError(t, err)
+	assert.Len(t, directoryCache.entries, 1, "expired entries are dropped")
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import "reflect"
+
+// Endpoints holds the paths of the server API, including their versions.
+// Paths with parameters are fmt format strings.
+// Fields left empty in Config.Endpoints take their value from DefaultEndpoints.
+type Endpoints struct {
+	RequestCode        string `yaml:"requestCode"`        // verification method and number
+	VerifyCode         string `yaml:"verifyCode"`         // verification code
+	RegistrationLock   string `yaml:"registrationLock"`   // registration lock PIN
+	AccountAttributes  string `yaml:"accountAttributes"`  // account attributes and capabilities
+	Keys               string `yaml:"keys"`               // upload of all prekeys
+	KeyCount           string `yaml:"keyCount"`           // number of one-time prekeys left
+	SignedKey          string `yaml:"signedKey"`          // upload of the signed prekey
+	PeerKeys           string `yaml:"peerKeys"`           // number and device ID
+	DirectoryTokens    string `yaml:"directoryTokens"`    // contact discovery
+	Receipt            string `yaml:"receipt"`            // source and timestamp
+	Attachments        string `yaml:"attachments"`        // attachment allocation
+	Attachment         string `yaml:"attachment"`         // attachment ID
+	Messages           string `yaml:"messages"`           // message queue
+	Message            string `yaml:"message"`            // destination number
+	DeleteMessage      string `yaml:"deleteMessage"`      // source and timestamp
+	Websocket          string `yaml:"websocket"`          // websocket connection
+	WebsocketKeepAlive string `yaml:"websocketKeepAlive"` // keepalive request path within the websocket
+}
+
+// DefaultEndpoints are the paths used by the TextSecure server.
+var DefaultEndpoints = Endpoints{
+	RequestCode:        "/v1/accounts/%s/code/%s",
+	VerifyCode:         "/v1/accounts/code/%s",
+	RegistrationLock:   "/v1/accounts/pin/",
+	AccountAttributes:  "/v1/accounts/attributes/",
+	Keys:               "/v2/keys/",
+	KeyCount:           "/v2/keys",
+	SignedKey:          "/v2/keys/signed",
+	PeerKeys:           "/v2/keys/%s/%s",
+	DirectoryTokens:    "/v1/directory/tokens/",
+	Receipt:            "/v1/receipt/%s/%d",
+	Attachments:        "/v1/attachments",
+	Attachment:         "/v1/attachments/%d",
+	Messages:           "/v1/messages/",
+	Message:            "/v1/messages/%s",
+	DeleteMessage:      "/v1/messages/%s/%d",
+	Websocket:          "/v1/websocket",
+	WebsocketKeepAlive: "/v1/keepalive",
+}
+
+// endpoints returns the configured endpoints, completed with the defaults.
+func endpoints() *Endpoints {
+	e := DefaultEndpoints
+	if conf() == nil || conf().Endpoints == nil {
+		return &e
+	}
+	ev := reflect.ValueOf(&e).Elem()
+	cv := reflect.ValueOf(conf().Endpoints).Elem()
+	for i := 0; i < cv.NumField(); i++ {
+		if p := cv.Field(i).String(); p != "" {
+			ev.Field(i).SetString(p)
+		}
+	}
+	return &e
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import "fmt"
+
+// environment holds the settings of a known server deployment.
+type environment struct {
+	server      string
+	fingerprint string
+	// rawWebsocketBodies is set when the server sends the encrypted envelopes
+	// in websocket requests as is, rather than base64 encoded
+	rawWebsocketBodies bool
+}
+
+const stagingServer = "https://textsecure-service-staging.whispersystems.org:443"
+
+// environments are the presets selectable with Config.Environment.
+// The production fingerprint is not known here, so it must be set explicitly.
+var environments = map[string]environment{
+	"staging": {
+		server:             stagingServer,
+		fingerprint:        "e221a8c5ad8198c89b06cd5a3995517b69ec0a9b23f0c00cc9a02fb72a612e7e",
+		rawWebsocketBodies: true,
+	},
+	"production": {
+		server: "https://textsecure-service.whispersystems.org:443",
+	},
+}
+
+// applyEnvironment fills in the server settings of the selected environment
+// which were not set explicitly.
+func (c *Config) applyEnvironment() error {
+	if c.Environment == "" {
+		return nil
+	}
+	env, ok := environments[c.Environment]
+	if !ok {
+		return fmt.Errorf("config: environment %q is not one of staging, production", c.Environment)
+	}
+	if c.Server == "" {
+		c.Server = env.server
+	}
+	if c.Fingerprint == "" {
+		c.Fingerprint = env.fingerprint
+	}
+	return nil
+}
+
+// rawWebsocketBodies reports whether the configured server sends websocket
+// request bodies without base64 encoding.
+func (c *Config) rawWebsocketBodies() bool {
+	if env, ok := environments[c.Environment]; ok && env.server == c.Server {
+		return env.rawWebsocketBodies
+	}
+	return c.Server == stagingServer
+}
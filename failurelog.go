@@ -0,0 +1,94 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DecryptionFailure records a received message which could not be decrypted,
+// so applications can tell the user which messages were lost.
+type DecryptionFailure struct {
+	Source    string `yaml:"source"`
+	Device    uint32 `yaml:"device"`
+	Timestamp uint64 `yaml:"timestamp"`
+	Error     string `yaml:"error"`
+}
+
+// maxDecryptionFailures bounds the failure log, dropping the oldest entries.
+const maxDecryptionFailures = 1000
+
+// failureLog keeps the decryption failures until the client clears them.
+// It is saved in the store, so it survives restarts.
+var failureLog = struct {
+	sync.Mutex
+	path     string
+	failures []DecryptionFailure
+}{}
+
+// setupFailureLog loads the decryption failures from the store.
+func setupFailureLog() error {
+	failureLog.Lock()
+	defer failureLog.Unlock()
+	failureLog.path = filepath.Join(storageDir, "decryption_failures")
+	failureLog.failures = nil
+	b, err := textSecureStore.readFile(failureLog.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(b, &failureLog.failures)
+}
+
+// saveFailureLog writes the decryption failures to the store, with failureLog locked.
+func saveFailureLog() error {
+	if failureLog.path == "" || textSecureStore == nil {
+		return nil
+	}
+	b, err := yaml.Marshal(failureLog.failures)
+	if err != nil {
+		return err
+	}
+	return textSecureStore.writeFile(failureLog.path, b)
+}
+
+// logDecryptionFailure adds a message which could not be decrypted to the log.
+func logDecryptionFailure(f DecryptionFailure) error {
+	failureLog.Lock()
+	defer failureLog.Unlock()
+	failureLog.failures = append(failureLog.failures, f)
+	if n := len(failureLog.failures); n > maxDecryptionFailures {
+		failureLog.failures = failureLog.failures[n-maxDecryptionFailures:]
+	}
+	return saveFailureLog()
+}
+
+// DecryptionFailures returns the received messages which could not be decrypted,
+// oldest first, since they were last cleared.
+func DecryptionFailures() []DecryptionFailure {
+	failureLog.Lock()
+	defer failureLog.Unlock()
+	return append([]DecryptionFailure{}, failureLog.failures...)
+}
+
+// ClearDecryptionFailures removes the logged decryption failures of messages from
+// the given source, once the user was told about them. An empty source clears all.
+func ClearDecryptionFailures(source string) error {
+	failureLog.Lock()
+	defer failureLog.Unlock()
+	kept := []DecryptionFailure{}
+	for _, f := range failureLog.failures {
+		if source != "" && f.Source != source {
+			kept = append(kept, f)
+		}
+	}
+	failureLog.failures = kept
+	return saveFailureLog()
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zmanian/textsecure/protobuf"
+)
+
+func TestDecryptionFailureLog(t *testing.T) {
+	defer setupTestStore(t)()
+	defer func() { failureLog.path, failureLog.failures = "", nil }()
+
+	assert.NoError(t, setupFailureLog())
+	assert.Empty(t, DecryptionFailures())
+
+	trackDecryption(envelope(textsecure.IncomingPushMessageSignal_CIPHERTEXT, "+14155550150", 1), errors.New("bad MAC"))
+	trackDecryption(envelope(textsecure.IncomingPushMessageSignal_CIPHERTEXT, "+14155550151", 2), errors.New("no session"))
+	trackDecryption(envelope(textsecure.IncomingPushMessageSignal_CIPHERTEXT, "+14155550150", 1), nil)
+	assert.Equal(t, []DecryptionFailure{
+		{"+14155550150", 1, 0, "bad MAC"},
+		{"+14155550151", 2, 0, "no session"},
+	}, DecryptionFailures())
+
+	// the log survives a restart
+	assert.NoError(t, ClearDecryptionFailures("+14155550150"))
+	assert.NoError(t, setupFailureLog())
+	assert.Equal(t, []DecryptionFailure{{"+14155550151", 2, 0, "no session"}}, DecryptionFailures())
+
+	assert.NoError(t, ClearDecryptionFailures(""))
+	assert.Empty(t, DecryptionFailures())
+}
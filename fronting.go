@@ -0,0 +1,108 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"log"
+	"net"
+	"net/url"
+	"sync"
+)
+
+// AlternateHost is another way to reach the server when its own host is blocked,
+// by domain fronting: connections go to the front domain, which presents its own
+// certificate and forwards the requests to the real host named in the Host header.
+type AlternateHost struct {
+	Front       string `yaml:"front"`       // domain connected to, optionally with a port
+	Host        string `yaml:"host"`        // server host name sent in the Host header, defaults to the server's
+	Fingerprint string `yaml:"fingerprint"` // hex encoded SHA256 hash of the front's public key
+}
+
+// frontAddr returns the address to dial for the front domain.
+func (a *AlternateHost) frontAddr() string {
+	if _, _, err := net.SplitHostPort(a.Front); err == nil {
+		return a.Front
+	}
+	return net.JoinHostPort(a.Front, "443")
+}
+
+// hostName returns the real host name the front forwards to.
+func (a *AlternateHost) hostName() string {
+	if a.Host != "" {
+		return a.Host
+	}
+	u, err := url.Parse(conf().Server)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// websocketURL returns the websocket URL of the server as reached through a front.
+func (a *AlternateHost) websocketURL() string {
+	u, err := url.Parse(conf().Server + endpoints().Websocket)
+	if err != nil {
+		return ""
+	}
+	u.Host = a.hostName()
+	return u.String()
+}
+
+// frontedTransporter sends requests to the server directly or through its
+// alternate hosts, moving to the next one when a connection fails and
+// sticking to the first one that works.
+type frontedTransporter struct {
+	sync.Mutex
+	hosts   []*httpTransporter
+	current int
+}
+
+func newFrontedTransporter(primary *httpTransporter, cfg *Config) *frontedTransporter {
+	ft := &frontedTransporter{hosts: []*httpTransporter{primary}}
+	for i := range cfg.AlternateHosts {
+		a := &cfg.AlternateHosts[i]
+		ht := NewHTTPTransporter("https://"+a.frontAddr(), cfg.Tel, registrationInfo.password, cfg.SkipTLSCheck, a.Fingerprint)
+		ht.host = a.hostName()
+		ft.hosts = append(ft.hosts, ht)
+	}
+	return ft
+}
+
+// try runs a request on each host in turn, starting with the last one that worked,
+// until one is reachable.
+func (ft *frontedTransporter) try(do func(*httpTransporter) (*response, error)) (*response, error) {
+	ft.Lock()
+	start := ft.current
+	ft.Unlock()
+	var resp *response
+	var err error
+	for i := range ft.hosts {
+		n := (start + i) % len(ft.hosts)
+		resp, err = do(ft.hosts[n])
+		if err == nil || !isTransportError(err) {
+			ft.Lock()
+			ft.current = n
+			ft.Unlock()
+			return resp, err
+		}
+		log.Printf("Could not reach %s: %s\n", ft.hosts[n].baseURL, err)
+	}
+	return resp, err
+}
+
+func (ft *frontedTransporter) get(url string) (*response, error) {
+	return ft.try(func(ht *httpTransporter) (*response, error) { return ht.get(url) })
+}
+
+func (ft *frontedTransporter) putJSON(url string, body []byte) (*response, error) {
+	return ft.try(func(ht *httpTransporter) (*response, error) { return ht.putJSON(url, body) })
+}
+
+func (ft *frontedTransporter) putBinary(url string, body []byte) (*response, error) {
+	return ft.try(func(ht *httpTransporter) (*response, error) { return ht.putBinary(url, body) })
+}
+
+func (ft *frontedTransporter) del(url string) (*response, error) {
+	return ft.try(func(ht *httpTransporter) (*response, error) { return ht.del(url) })
+}
@@ -7,9 +7,11 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/zmanian/textsecure/protobuf"
 	"gopkg.in/yaml.v2"
@@ -108,6 +110,25 @@ func removeMember(tel string, members []string) []string {
 	return members
 }
 
+// renameGroupMember replaces a member's number with a new one in all the groups.
+func renameGroupMember(oldTel, newTel string) error {
+	for hexid, g := range groups {
+		changed := false
+		for i, m := range g.Members {
+			if m == oldTel {
+				g.Members[i] = newTel
+				changed = true
+			}
+		}
+		if changed {
+			if err := saveGroup(hexid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // updateGroup updates a group's state based on an incoming message.
 func updateGroup(gr *textsecure.PushMessageContent_GroupContext) error {
 	hexid := idToHex(gr.GetId())
@@ -117,7 +138,7 @@ func updateGroup(gr *textsecure.PushMessageContent_GroupContext) error {
 		if err != nil {
 			return err
 		}
-		ioutil.WriteFile(avatarPath(hexid), avatarContents, 0600)
+		textSecureStore.writeFile(avatarPath(hexid), avatarContents)
 	}
 
 	groups[hexid] = &Group{
@@ -157,7 +178,7 @@ func handleGroups(src string, pmc *textsecure.PushMessageContent) (string, error
 		if g, ok := groups[hexid]; ok {
 			return g.Name, nil
 		}
-		return "", fmt.Errorf("Unknown group ID %s\n", hexid)
+		return recoverGroup(src, gr).Name, nil
 	case textsecure.PushMessageContent_GroupContext_QUIT:
 		if err := quitGroup(src, hexid); err != nil {
 			return "", err
@@ -167,6 +188,31 @@ func handleGroups(src string, pmc *textsecure.PushMessageContent) (string, error
 	return "", nil
 }
 
+// recoverGroup stores a group we received a message for but know nothing about,
+// as after losing the local state, so replies can be sent to it. Until the next
+// group update it is named after its ID and only has the members seen so far.
+func recoverGroup(src string, gr *textsecure.PushMessageContent_GroupContext) *Group {
+	hexid := idToHex(gr.GetId())
+	name := gr.GetName()
+	if name == "" {
+		name = hexid
+	}
+	members := gr.GetMembers()
+	if len(members) == 0 {
+		members = []string{src, conf().Tel}
+	}
+	log.Printf("Recovering unknown group %s from a message by %s\n", hexid, src)
+	groups[hexid] = &Group{
+		ID:      gr.GetId(),
+		Name:    name,
+		Members: members,
+	}
+	if err := saveGroup(hexid); err != nil {
+		log.Println(err)
+	}
+	return groups[hexid]
+}
+
 type groupMessage struct {
 	id      []byte
 	name    string
@@ -174,26 +220,100 @@ type groupMessage struct {
 	typ     textsecure.PushMessageContent_GroupContext_Type
 }
 
+// GroupSendError is returned by group sends which did not reach every member,
+// with the error for each member who did not get the message, so the send
+// can be retried for those only with SendToGroupMembers.
+type GroupSendError struct {
+	Failures map[string]error
+}
+
+func (err GroupSendError) Error() string {
+	return fmt.Sprintf("Group message not delivered to %d members", len(err.Failures))
+}
+
+const defaultSendConcurrency = 4
+
+// sendConcurrency returns the number of group members a message is sent to in parallel.
+func sendConcurrency() int {
+	if conf() != nil && conf().SendConcurrency > 0 {
+		return conf().SendConcurrency
+	}
+	return defaultSendConcurrency
+}
+
+// sendGroupDeliver sends a text message tagged with the given group ID to the group members,
+// returning a GroupSendError if it failed for any of them.
+// Up to sendConcurrency members are sent to at once, and it returns when all sends are done.
+func sendGroupDeliver(id []byte, members []string, msg string, atts []*AttachmentPointer) error {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		failures = make(map[string]error)
+		sem      = make(chan struct{}, sendConcurrency())
+	)
+	for _, m := range members {
+		if m == conf().Tel {
+			continue
+		}
+		omsg := &outgoingMessage{
+			tel:         m,
+			msg:         msg,
+			attachments: atts,
+			group: &groupMessage{
+				id:  id,
+				typ: textsecure.PushMessageContent_GroupContext_DELIVER,
+			},
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(m string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := sendMessage(omsg); err != nil {
+				mu.Lock()
+				failures[m] = err
+				mu.Unlock()
+			}
+		}(m)
+	}
+	wg.Wait()
+	if len(failures) > 0 {
+		return GroupSendError{failures}
+	}
+	return nil
+}
+
 // SendGroupMessage sends a text message to a given group.
+// If it did not reach every member, the error is a GroupSendError.
 func SendGroupMessage(name string, msg string) error {
+	return SendGroupMessageWithAttachments(name, msg, nil)
+}
+
+// SendGroupMessageWithAttachments sends a message with attachments uploaded
+// beforehand with UploadAttachment to a given group.
+func SendGroupMessageWithAttachments(name string, msg string, atts []*AttachmentPointer) error {
 	g := groupByName(name)
 	if g == nil {
 		return fmt.Errorf("Unknown group %s\n", name)
 	}
-	for _, m := range g.Members {
-		if m != config.Tel {
-			omsg := &outgoingMessage{
-				tel: m,
-				msg: msg,
-				group: &groupMessage{
-					id:  g.ID,
-					typ: textsecure.PushMessageContent_GroupContext_DELIVER,
-				},
-			}
-			sendMessage(omsg)
-		}
+	return sendGroupDeliver(g.ID, g.Members, msg, atts)
+}
+
+// SendToGroupMembers sends a text message to the given members as part of the group
+// with the given hex encoded ID, without the group needing to be stored locally.
+// It is useful when group membership is managed externally.
+func SendToGroupMembers(groupID string, members []string, msg string) error {
+	id, err := hex.DecodeString(groupID)
+	if err != nil {
+		return fmt.Errorf("Invalid group ID %s: %s\n", groupID, err)
 	}
-	return nil
+	members, err = normalizeRecipients(members)
+	if err != nil {
+		return err
+	}
+	return sendGroupDeliver(id, members, msg, nil)
 }
 
 func newGroupID() []byte {
@@ -208,7 +328,7 @@ func newGroup(name string, members []string) *Group {
 	groups[hexid] = &Group{
 		ID:      id,
 		Name:    name,
-		Members: append(members, config.Tel),
+		Members: append(members, conf().Tel),
 	}
 	saveGroup(hexid)
 	return groups[hexid]
@@ -221,11 +341,15 @@ func NewGroup(name string, members []string) error {
 	if g != nil {
 		return fmt.Errorf("Not creating existing group %s\n", name)
 	}
+	members, err := normalizeRecipients(members)
+	if err != nil {
+		return err
+	}
 
 	g = newGroup(name, members)
 
 	for _, m := range g.Members {
-		if m != config.Tel {
+		if m != conf().Tel {
 			omsg := &outgoingMessage{
 				tel: m,
 				group: &groupMessage{
@@ -241,25 +365,39 @@ func NewGroup(name string, members []string) error {
 	return nil
 }
 
+// removeGroup deletes all local state of a group.
 func removeGroup(id []byte) error {
 	hexid := idToHex(id)
+	delete(groups, hexid)
 	err := os.Remove(idToPath(hexid))
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	os.Remove(avatarPath(hexid))
 	return nil
 }
 
-// LeaveGroup sends a group quit message to the other members of the given group.
+// GetGroups returns the groups we are a member of.
+func GetGroups() []*Group {
+	gs := make([]*Group, 0, len(groups))
+	for _, g := range groups {
+		gs = append(gs, g)
+	}
+	return gs
+}
+
+// LeaveGroup sends a group quit message to the other members of the given group
+// and forgets the group. Leaving a group which is not known does nothing.
 func LeaveGroup(name string) error {
 	g := groupByName(name)
 	if g == nil {
-		return fmt.Errorf("Inexistent group %s\n", name)
+		log.Printf("Not leaving unknown group %s\n", name)
+		return nil
 	}
 
+	var err error
 	for _, m := range g.Members {
-		if m != config.Tel {
+		if m != conf().Tel {
 			omsg := &outgoingMessage{
 				tel: m,
 				group: &groupMessage{
@@ -267,9 +405,14 @@ func LeaveGroup(name string) error {
 					typ: textsecure.PushMessageContent_GroupContext_QUIT,
 				},
 			}
-			sendMessage(omsg)
+			if serr := sendMessage(omsg); serr != nil {
+				log.Printf("Could not send group quit message to %s: %s\n", m, serr)
+				err = serr
+			}
 		}
 	}
-	removeGroup(g.ID)
-	return nil
+	if rerr := removeGroup(g.ID); rerr != nil {
+		return rerr
+	}
+	return err
 }
@@ -0,0 +1,81 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupSendError(t *testing.T) {
+	defer setupTestStore(t)()
+	config, transport = &Config{Tel: "+14155550100"}, downTransport{}
+
+	err := SendToGroupMembers("00112233445566778899", []string{"+14155550100", "+14155550120", "+14155550121"}, "hello")
+	if assert.IsType(t, GroupSendError{}, err) {
+		failures := err.(GroupSendError).Failures
+		assert.Len(t, failures, 2, "we do not send to ourselves")
+		assert.Equal(t, ErrServerUnavailable, failures["+14155550120"])
+		assert.Equal(t, ErrServerUnavailable, failures["+14155550121"])
+	}
+}
+
+// slowTransport fails every request after a delay, recording the most requests in flight at once.
+type slowTransport struct {
+	downTransport
+	inFlight, maxInFlight *int32
+}
+
+func (t slowTransport) get(url string) (*response, error) {
+	n := atomic.AddInt32(t.inFlight, 1)
+	defer atomic.AddInt32(t.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(t.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(t.maxInFlight, max, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return nil, ErrServerUnavailable
+}
+
+func TestGroupSendConcurrency(t *testing.T) {
+	defer setupTestStore(t)()
+	var inFlight, maxInFlight int32
+	config = &Config{Tel: "+14155550100", SendConcurrency: 2}
+	transport = slowTransport{inFlight: &inFlight, maxInFlight: &maxInFlight}
+
+	members := []string{"+14155550120", "+14155550121", "+14155550122", "+14155550123", "+14155550124"}
+	err := SendToGroupMembers("00112233445566778899", members, "hello")
+	if assert.IsType(t, GroupSendError{}, err) {
+		assert.Len(t, err.(GroupSendError).Failures, len(members), "it returns once every member was tried")
+	}
+	assert.Equal(t, int32(2), maxInFlight, "members are sent to in parallel, up to sendConcurrency at once")
+	assert.Equal(t, int32(0), inFlight)
+}
+
+func TestRenameGroupMember(t *testing.T) {
+	dir, err := ioutil.TempDir("", "textsecure")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	groupDir = dir
+	groups = map[string]*Group{
+		"0011": {ID: []byte{0, 0x11}, Name: "a", Members: []string{"+14155550100", "+14155550140"}},
+		"0022": {ID: []byte{0, 0x22}, Name: "b", Members: []string{"+14155550141"}},
+	}
+	defer func() { groups = map[string]*Group{} }()
+
+	assert.NoError(t, renameGroupMember("+14155550100", "+14155550199"))
+	assert.Equal(t, []string{"+14155550199", "+14155550140"}, groups["0011"].Members)
+	assert.Equal(t, []string{"+14155550141"}, groups["0022"].Members)
+
+	groups = map[string]*Group{}
+	assert.NoError(t, loadGroup(idToPath("0011")))
+	assert.Equal(t, []string{"+14155550199", "+14155550140"}, groups["0011"].Members)
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/zmanian/textsecure/axolotl"
+)
+
+// identityKeyBytes accepts an identity key either as 32 raw bytes
+// or serialized with the leading key type byte, as sent on the wire.
+func identityKeyBytes(key []byte) ([]byte, error) {
+	if len(key) == 33 && key[0] == 5 {
+		key = key[1:]
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Identity key is %d not 32 bytes long", len(key))
+	}
+	return key, nil
+}
+
+// TrustIdentities stores the given identity keys as trusted for the given numbers,
+// replacing any previously trusted ones, so that first contact with them does not
+// rely on trust on first use.
+func TrustIdentities(keys map[string][]byte) error {
+	for tel, key := range keys {
+		tel, err := normalizeRecipient(tel)
+		if err != nil {
+			return err
+		}
+		recid, err := recID(tel)
+		if err != nil {
+			return err
+		}
+		b, err := identityKeyBytes(key)
+		if err != nil {
+			return fmt.Errorf("%s: %s", tel, err)
+		}
+		err = textSecureStore.SaveIdentity(recid, axolotl.NewIdentityKey(b))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Trust is an application's decision on an identity key seen for the first time
+// or different from the trusted one, returned by Client.TrustDecision.
+type Trust int
+
+const (
+	// TrustDefer applies the default policy: trust on first use, reject changed keys.
+	TrustDefer Trust = iota
+	// TrustAccept trusts the key, replacing any previously trusted one.
+	TrustAccept
+	// TrustReject fails the send or receive with an axolotl.NotTrustedError.
+	TrustReject
+)
+
+// decideTrust asks the application what to do with an identity key
+// which is not the trusted one for the given recipient ID.
+func decideTrust(id string, key *axolotl.IdentityKey, firstUse bool) Trust {
+	if client == nil || client.TrustDecision == nil {
+		return TrustDefer
+	}
+	return client.TrustDecision(telFromRecID(id), key.Key()[:], firstUse)
+}
+
+var digitsRegexp = regexp.MustCompile(`^[0-9]+$`)
+
+// telFromRecID returns the number a recipient ID was derived from.
+func telFromRecID(id string) string {
+	if digitsRegexp.MatchString(id) {
+		return "+" + id
+	}
+	return id
+}
+
+// TrustedIdentities returns the currently trusted identity keys, indexed by number.
+func TrustedIdentities() (map[string][]byte, error) {
+	ids, err := textSecureStore.remoteIdentities()
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte)
+	for _, id := range ids {
+		key, err := textSecureStore.loadRemoteIdentity(id)
+		if err != nil {
+			return nil, err
+		}
+		keys[telFromRecID(id)] = key.Key()[:]
+	}
+	return keys, nil
+}
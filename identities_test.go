@@ -0,0 +1,53 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zmanian/textsecure/axolotl"
+)
+
+func TestTrustDecision(t *testing.T) {
+	defer setupTestStore(t)()
+	s := textSecureStore
+
+	first := axolotl.GenerateIdentityKeyPair().PublicKey
+	changed := axolotl.GenerateIdentityKeyPair().PublicKey
+
+	// without a callback, first keys are trusted and changed keys rejected
+	assert.True(t, s.IsTrustedIdentity("14155550100", &first))
+	assert.NoError(t, s.SaveIdentity("14155550100", &first))
+	assert.True(t, s.IsTrustedIdentity("14155550100", &first))
+	assert.False(t, s.IsTrustedIdentity("14155550100", &changed))
+
+	type call struct {
+		tel      string
+		firstUse bool
+	}
+	var calls []call
+	decision := TrustDefer
+	client = &Client{TrustDecision: func(tel string, key []byte, firstUse bool) Trust {
+		assert.Len(t, key, 32)
+		calls = append(calls, call{tel, firstUse})
+		return decision
+	}}
+	defer func() { client = nil }()
+
+	assert.True(t, s.IsTrustedIdentity("14155550100", &first), "the trusted key needs no decision")
+	assert.Empty(t, calls)
+
+	assert.False(t, s.IsTrustedIdentity("14155550100", &changed))
+	decision = TrustAccept
+	assert.True(t, s.IsTrustedIdentity("14155550100", &changed))
+
+	decision = TrustReject
+	assert.False(t, s.IsTrustedIdentity("14155550101", &first))
+	assert.Equal(t, []call{
+		{"+14155550100", false},
+		{"+14155550100", false},
+		{"+14155550101", true},
+	}, calls)
+}
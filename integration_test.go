@@ -0,0 +1,136 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zmanian/textsecure/axolotl"
+	"github.com/zmanian/textsecure/curve25519sign"
+	"github.com/zmanian/textsecure/internal/testutil"
+	"github.com/zmanian/textsecure/protobuf"
+)
+
+// peerKeys generates the keys a peer uploads to the server.
+func peerKeys() *testutil.PreKeyState {
+	ikp := axolotl.GenerateIdentityKeyPair()
+	spk := axolotl.NewECKeyPair()
+	var random [64]byte
+	randBytes(random[:])
+	sig := curve25519sign.Sign(ikp.PrivateKey.Key(), spk.PublicKey.Serialize(), random)
+	pk := axolotl.NewECKeyPair()
+	return &testutil.PreKeyState{
+		IdentityKey: base64EncWithoutPadding(ikp.PublicKey.Serialize()),
+		PreKeys: []*testutil.PreKey{{
+			KeyID:     1,
+			PublicKey: base64EncWithoutPadding(pk.PublicKey.Serialize()),
+		}},
+		SignedPreKey: &testutil.SignedPreKey{
+			KeyID:     1,
+			PublicKey: base64EncWithoutPadding(spk.PublicKey.Serialize()),
+			Signature: base64EncWithoutPadding(sig[:]),
+		},
+	}
+}
+
+func TestIntegration(t *testing.T) {
+	srv := testutil.NewServer()
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "textsecure")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer stopSignedPreKeyRotation()
+
+	const self, peer = "+14155550100", "+14155550101"
+	srv.AddAccount(peer, 42, peerKeys())
+
+	var receipts []uint64
+	queueEmpty := false
+	err = Setup(&Client{
+		RootDir: dir,
+		GetConfig: func() (*Config, error) {
+			return &Config{
+				Tel:                self,
+				Server:             srv.URL,
+				VerificationType:   "dev",
+				UnencryptedStorage: true,
+				AllowInsecure:      true,
+			}, nil
+		},
+		ReceiptHandler: func(source string, ts uint64) { receipts = append(receipts, ts) },
+		QueueEmptyHandler: func() {
+			queueEmpty = true
+			// the server dropping the connection is retried, refusing it ends ListenForMessages
+			srv.RefuseWebsocket(true)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, preKeyBatchSize(), srv.PreKeyCount(self))
+
+	// The first message starts a session with the peer's prekeys
+	assert.NoError(t, SendMessage(peer, "hello"))
+	sent := srv.Queue(peer)
+	if !assert.Len(t, sent, 1) {
+		return
+	}
+	assert.Equal(t, int32(textsecure.IncomingPushMessageSignal_PREKEY_BUNDLE), sent[0].Type)
+	assert.Equal(t, self, sent[0].Source)
+	assert.Equal(t, 0, srv.PreKeyCount(peer))
+
+	has, err := HasSession(peer)
+	assert.NoError(t, err)
+	assert.True(t, has)
+
+	// Receipts are delivered over the websocket and acknowledged
+	receipt := testutil.QueuedMessage{
+		Type:         int32(textsecure.IncomingPushMessageSignal_RECEIPT),
+		Source:       peer,
+		SourceDevice: 1,
+		Timestamp:    sent[0].Timestamp,
+	}
+	srv.Enqueue(self, receipt)
+	assert.Equal(t, ErrConnectionClosed, ListenForMessages())
+	srv.RefuseWebsocket(false)
+	assert.Equal(t, []uint64{sent[0].Timestamp}, receipts)
+	assert.True(t, queueEmpty)
+	assert.Empty(t, srv.Queue(self))
+
+	// and over HTTP
+	receipt.Timestamp++
+	srv.Enqueue(self, receipt)
+	msgs, err := ReceiveMessages()
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+	assert.Equal(t, []uint64{sent[0].Timestamp, sent[0].Timestamp + 1}, receipts)
+	assert.Empty(t, srv.Queue(self))
+
+	// Resetting the session sends an end session message in a new session
+	assert.NoError(t, ResetSession(peer))
+	sent = srv.Queue(peer)
+	if assert.Len(t, sent, 2) {
+		assert.Equal(t, int32(textsecure.IncomingPushMessageSignal_PREKEY_BUNDLE), sent[1].Type)
+	}
+	has, err = HasSession(peer)
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	// A failed number change leaves everything as it was
+	const newTel = "+14155550102"
+	assert.NoError(t, RequestNumberChangeCode(newTel, "dev"))
+	tr := currentTransport()
+	assert.Error(t, ChangeNumber(newTel, "000-000"))
+	assert.True(t, tr == currentTransport(), "the transport is only replaced after the change")
+	assert.Equal(t, self, conf().Tel)
+	assert.Equal(t, self, textSecureStore.loadRegisteredTel())
+
+	assert.NoError(t, ChangeNumber(newTel, srv.VerificationCode))
+	assert.Equal(t, newTel, conf().Tel)
+	assert.Equal(t, newTel, textSecureStore.loadRegisteredTel())
+	assert.True(t, srv.PreKeyCount(newTel) >= preKeyBatchSize(), "the new number has prekeys before the change is committed")
+}
@@ -0,0 +1,482 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+// Package testutil provides an in-memory TextSecure server for tests.
+package testutil
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/zmanian/textsecure/axolotl"
+	"github.com/zmanian/textsecure/protobuf"
+	"golang.org/x/net/websocket"
+)
+
+// PreKey is a one-time prekey as uploaded to the server.
+type PreKey struct {
+	KeyID     uint32 `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+}
+
+// SignedPreKey is a signed prekey as uploaded to the server.
+type SignedPreKey struct {
+	KeyID     uint32 `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+// PreKeyState holds the keys an account uploaded to the server.
+type PreKeyState struct {
+	IdentityKey   string        `json:"identityKey"`
+	PreKeys       []*PreKey     `json:"preKeys"`
+	LastResortKey *PreKey       `json:"lastResortKey"`
+	SignedPreKey  *SignedPreKey `json:"signedPreKey"`
+}
+
+// QueuedMessage is a message waiting to be delivered to an account.
+type QueuedMessage struct {
+	Type         int32  `json:"type"`
+	Relay        string `json:"relay"`
+	Timestamp    uint64 `json:"timestamp"`
+	Source       string `json:"source"`
+	SourceDevice uint32 `json:"sourceDevice"`
+	Message      []byte `json:"message"`
+}
+
+type account struct {
+	password       string
+	signalingKey   []byte
+	registrationID uint32
+	keys           *PreKeyState
+	queue          []QueuedMessage
+}
+
+// Server implements the subset of the TextSecure server API used by the client:
+// number verification, prekeys, sending and fetching messages and the websocket.
+// Every account has a single device, with ID 1.
+type Server struct {
+	*httptest.Server
+
+	// VerificationCode is the code expected when verifying a number.
+	// It is returned in the response body for the "dev" verification method.
+	VerificationCode string
+
+	mu       sync.Mutex
+	accounts map[string]*account
+	refuseWS bool
+}
+
+// NewServer starts a server listening on a local address.
+func NewServer() *Server {
+	s := &Server{
+		VerificationCode: "123-456",
+		accounts:         make(map[string]*account),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/accounts/", s.handleAccounts)
+	mux.HandleFunc("/v2/keys", s.handleKeyCount)
+	mux.HandleFunc("/v2/keys/", s.handleKeys)
+	mux.HandleFunc("/v1/messages/", s.handleMessages)
+	mux.Handle("/v1/websocket", websocket.Server{Handshake: s.websocketHandshake, Handler: s.handleWebsocket})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// AddAccount registers an account with the given keys, to act as a peer.
+func (s *Server) AddAccount(tel string, registrationID uint32, keys *PreKeyState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts[tel] = &account{
+		registrationID: registrationID,
+		keys:           keys,
+	}
+}
+
+// Queue returns the messages waiting to be delivered to an account.
+func (s *Server) Queue(tel string) []QueuedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[tel]
+	if !ok {
+		return nil
+	}
+	return append([]QueuedMessage{}, a.queue...)
+}
+
+// Enqueue adds a message for delivery to an account.
+func (s *Server) Enqueue(tel string, m QueuedMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.accounts[tel]; ok {
+		a.queue = append(a.queue, m)
+	}
+}
+
+// PreKeyCount returns the number of one-time prekeys an account has left.
+func (s *Server) PreKeyCount(tel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.accounts[tel]
+	if !ok || a.keys == nil {
+		return 0
+	}
+	return len(a.keys.PreKeys)
+}
+
+// authenticate returns the account of the request's credentials.
+// It must be called with s.mu held.
+func (s *Server) authenticate(user, pass string) (*account, bool) {
+	a, ok := s.accounts[user]
+	if !ok || a.password == "" || a.password != pass {
+		return nil, false
+	}
+	return a, true
+}
+
+func (s *Server) authenticateRequest(r *http.Request) (string, *account, bool) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", nil, false
+	}
+	a, ok := s.authenticate(user, pass)
+	return user, a, ok
+}
+
+type verificationData struct {
+	SignalingKey   string `json:"signalingKey"`
+	RegistrationID uint32 `json:"registrationId"`
+}
+
+// GET /v1/accounts/{transport}/code/{number}
+// PUT /v1/accounts/code/{verification_code}
+func (s *Server) handleAccounts(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/accounts/"), "/")
+	switch {
+	case r.Method == "GET" && len(parts) == 3 && parts[1] == "code":
+		if parts[0] == "dev" {
+			fmt.Fprint(w, s.VerificationCode)
+		}
+	case r.Method == "PUT" && len(parts) == 2 && parts[0] == "code":
+		if parts[1] != strings.Replace(s.VerificationCode, "-", "", -1) {
+			http.Error(w, "wrong verification code", http.StatusForbidden)
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			http.Error(w, "no credentials", http.StatusUnauthorized)
+			return
+		}
+		vd := &verificationData{}
+		err := json.NewDecoder(r.Body).Decode(vd)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sk, err := base64.StdEncoding.DecodeString(vd.SignalingKey)
+		if err != nil || len(sk) != 52 {
+			http.Error(w, "invalid signaling key", http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.accounts[user] = &account{
+			password:       pass,
+			signalingKey:   sk,
+			registrationID: vd.RegistrationID,
+		}
+		s.mu.Unlock()
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// GET /v2/keys
+func (s *Server) handleKeyCount(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, a, ok := s.authenticateRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	count := 0
+	if a.keys != nil {
+		count = len(a.keys.PreKeys)
+	}
+	json.NewEncoder(w).Encode(map[string]int{"count": count})
+}
+
+type preKeyResponseItem struct {
+	DeviceID       uint32        `json:"deviceId"`
+	RegistrationID uint32        `json:"registrationId"`
+	SignedPreKey   *SignedPreKey `json:"signedPreKey"`
+	PreKey         *PreKey       `json:"preKey"`
+}
+
+type preKeyResponse struct {
+	IdentityKey string               `json:"identityKey"`
+	Devices     []preKeyResponseItem `json:"devices"`
+}
+
+// PUT /v2/keys/
+// PUT /v2/keys/signed
+// GET /v2/keys/{number}/{device_id}
+func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, self, ok := s.authenticateRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v2/keys/")
+	switch {
+	case r.Method == "PUT" && path == "":
+		keys := &PreKeyState{}
+		err := json.NewDecoder(r.Body).Decode(keys)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		self.keys = keys
+	case r.Method == "PUT" && path == "signed":
+		spk := &SignedPreKey{}
+		err := json.NewDecoder(r.Body).Decode(spk)
+		if err != nil || self.keys == nil {
+			http.Error(w, "invalid signed prekey", http.StatusBadRequest)
+			return
+		}
+		self.keys.SignedPreKey = spk
+	case r.Method == "GET":
+		parts := strings.Split(path, "/")
+		a, ok := s.accounts[parts[0]]
+		if len(parts) != 2 || !ok || a.keys == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if parts[1] != "*" && parts[1] != "1" {
+			http.NotFound(w, r)
+			return
+		}
+		pk := a.keys.LastResortKey
+		if len(a.keys.PreKeys) > 0 {
+			pk = a.keys.PreKeys[0]
+			a.keys.PreKeys = a.keys.PreKeys[1:]
+		}
+		json.NewEncoder(w).Encode(&preKeyResponse{
+			IdentityKey: a.keys.IdentityKey,
+			Devices: []preKeyResponseItem{{
+				DeviceID:       1,
+				RegistrationID: a.registrationID,
+				SignedPreKey:   a.keys.SignedPreKey,
+				PreKey:         pk,
+			}},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type outgoingMessage struct {
+	Type int32  `json:"type"`
+	Body string `json:"body"`
+}
+
+type outgoingMessages struct {
+	Destination string            `json:"destination"`
+	Timestamp   uint64            `json:"timestamp"`
+	Messages    []outgoingMessage `json:"messages"`
+}
+
+// PUT /v1/messages/{destination}
+// GET /v1/messages/
+// DELETE /v1/messages/{source}/{timestamp}
+func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, self, ok := s.authenticateRequest(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v1/messages/")
+	switch r.Method {
+	case "PUT":
+		dest, ok := s.accounts[path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		om := &outgoingMessages{}
+		err := json.NewDecoder(r.Body).Decode(om)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, m := range om.Messages {
+			b, err := base64.StdEncoding.DecodeString(m.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			dest.queue = append(dest.queue, QueuedMessage{
+				Type:         m.Type,
+				Timestamp:    om.Timestamp,
+				Source:       user,
+				SourceDevice: 1,
+				Message:      b,
+			})
+		}
+	case "GET":
+		json.NewEncoder(w).Encode(map[string][]QueuedMessage{"messages": self.queue})
+	case "DELETE":
+		parts := strings.Split(path, "/")
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		ts, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		self.remove(parts[0], ts)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// remove deletes a message from the queue.
+func (a *account) remove(source string, timestamp uint64) {
+	for i, m := range a.queue {
+		if m.Source == source && m.Timestamp == timestamp {
+			a.queue = append(a.queue[:i], a.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// encryptEnvelope encrypts an envelope with the signaling key of the recipient,
+// in the format the client expects for websocket deliveries.
+func encryptEnvelope(m QueuedMessage, signalingKey []byte) ([]byte, error) {
+	typ := textsecure.IncomingPushMessageSignal_Type(m.Type)
+	b, err := proto.Marshal(&textsecure.IncomingPushMessageSignal{
+		Type:         &typ,
+		Source:       &m.Source,
+		SourceDevice: &m.SourceDevice,
+		Relay:        &m.Relay,
+		Timestamp:    &m.Timestamp,
+		Message:      m.Message,
+	})
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, 16)
+	rand.Read(iv)
+	e, err := axolotl.Encrypt(signalingKey[:32], iv, b)
+	if err != nil {
+		return nil, err
+	}
+	msg := append([]byte{1}, iv...)
+	msg = append(msg, e...)
+	return append(msg, axolotl.ComputeTruncatedMAC(msg, signalingKey[32:], 10)...), nil
+}
+
+func (s *Server) sendRequest(ws *websocket.Conn, id uint64, path string, body []byte) error {
+	typ := textsecure.WebSocketMessage_REQUEST
+	verb := "PUT"
+	b, err := proto.Marshal(&textsecure.WebSocketMessage{
+		Type: &typ,
+		Request: &textsecure.WebSocketRequestMessage{
+			Verb: &verb,
+			Path: &path,
+			Body: body,
+			Id:   &id,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return websocket.Message.Send(ws, b)
+}
+
+// RefuseWebsocket makes the server reject websocket connections, as the real
+// server does for credentials which are no longer valid, or accept them again.
+func (s *Server) RefuseWebsocket(refuse bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refuseWS = refuse
+}
+
+// websocketHandshake fails the handshake, with 403 Forbidden, while websockets are refused.
+func (s *Server) websocketHandshake(config *websocket.Config, r *http.Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refuseWS {
+		return errors.New("websocket refused")
+	}
+	return nil
+}
+
+// handleWebsocket delivers the queued messages, removing the acknowledged ones,
+// then sends the queue-empty marker and closes the connection once that is
+// acknowledged too.
+func (s *Server) handleWebsocket(ws *websocket.Conn) {
+	defer ws.Close()
+	q := ws.Request().URL.Query()
+	user := q.Get("login")
+	s.mu.Lock()
+	a, ok := s.authenticate(user, q.Get("password"))
+	var queue []QueuedMessage
+	if ok {
+		queue = append(queue, a.queue...)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	for i, m := range queue {
+		b, err := encryptEnvelope(m, a.signalingKey)
+		if err != nil {
+			return
+		}
+		body := []byte(base64.StdEncoding.EncodeToString(b))
+		if s.sendRequest(ws, uint64(i), "/api/v1/message", body) != nil {
+			return
+		}
+	}
+	emptyID := uint64(len(queue))
+	if s.sendRequest(ws, emptyID, "/api/v1/queue/empty", nil) != nil {
+		return
+	}
+
+	for {
+		var b []byte
+		if websocket.Message.Receive(ws, &b) != nil {
+			return
+		}
+		wsm := &textsecure.WebSocketMessage{}
+		if proto.Unmarshal(b, wsm) != nil || wsm.GetType() != textsecure.WebSocketMessage_RESPONSE {
+			continue
+		}
+		id := wsm.GetResponse().GetId()
+		if id == emptyID {
+			return
+		}
+		if id < emptyID {
+			s.mu.Lock()
+			a.remove(queue[id].Source, queue[id].Timestamp)
+			s.mu.Unlock()
+		}
+	}
+}
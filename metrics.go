@@ -0,0 +1,38 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import "time"
+
+// Metrics receives counters and latencies from the library,
+// so they can be exported to a monitoring system.
+// Its methods may be called from several goroutines at once.
+type Metrics interface {
+	IncCounter(name string)
+	ObserveLatency(name string, d time.Duration)
+}
+
+// Names of the counters and latencies reported to Metrics.
+const (
+	MetricMessagesSent       = "messages_sent"
+	MetricSendFailures       = "send_failures"
+	MetricSendLatency        = "send_latency"
+	MetricMessagesReceived   = "messages_received"
+	MetricDecryptionFailures = "decryption_failures"
+	MetricWebsocketConnects  = "websocket_connects"
+	MetricWebsocketErrors    = "websocket_errors"
+)
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncCounter(name string)                      {}
+func (noopMetrics) ObserveLatency(name string, d time.Duration) {}
+
+// metrics returns the client's Metrics implementation or a no-op one.
+func metrics() Metrics {
+	if client == nil || client.Metrics == nil {
+		return noopMetrics{}
+	}
+	return client.Metrics
+}
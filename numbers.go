@@ -0,0 +1,62 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidNumber is returned when a phone number cannot be normalized to E.164 format.
+var ErrInvalidNumber = errors.New("Invalid phone number, expected E.164 format such as +14155550100")
+
+var e164 = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// normalizeTel strips separators from a phone number and returns it in E.164 format.
+// Numbers without a leading + get the given default country code, if any.
+func normalizeTel(tel, defaultCountryCode string) (string, error) {
+	tel = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')', '/':
+			return -1
+		}
+		return r
+	}, tel)
+
+	switch {
+	case strings.HasPrefix(tel, "+"):
+	case strings.HasPrefix(tel, "00"):
+		tel = "+" + tel[2:]
+	case defaultCountryCode != "":
+		tel = "+" + strings.TrimPrefix(defaultCountryCode, "+") + strings.TrimPrefix(tel, "0")
+	}
+
+	if !e164.MatchString(tel) {
+		return "", ErrInvalidNumber
+	}
+	return tel, nil
+}
+
+// normalizeRecipient normalizes a recipient number using the configured default country code.
+func normalizeRecipient(tel string) (string, error) {
+	cc := ""
+	if conf() != nil {
+		cc = conf().DefaultCountryCode
+	}
+	return normalizeTel(tel, cc)
+}
+
+// normalizeRecipients normalizes a list of recipient numbers.
+func normalizeRecipients(tels []string) ([]string, error) {
+	n := make([]string, len(tels))
+	for i, tel := range tels {
+		var err error
+		n[i], err = normalizeRecipient(tel)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
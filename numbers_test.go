@@ -0,0 +1,35 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeTel(t *testing.T) {
+	valid := map[string]string{
+		"+14155550100":      "+14155550100",
+		"+1 (415) 555-0100": "+14155550100",
+		"0014155550100":     "+14155550100",
+		"415.555.0100":      "+14155550100",
+	}
+	for in, out := range valid {
+		n, err := normalizeTel(in, "1")
+		if assert.NoError(t, err, in) {
+			assert.Equal(t, out, n, in)
+		}
+	}
+
+	n, err := normalizeTel("030 1234567", "+49")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "+49301234567", n)
+	}
+
+	for _, in := range []string{"", "+", "4155550100", "+0155550100", "+1415555abcd"} {
+		_, err := normalizeTel(in, "")
+		assert.Equal(t, ErrInvalidNumber, err, in)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// passwordFromEnv reads the storage password from an environment variable.
+func passwordFromEnv(name string) (string, error) {
+	p, ok := os.LookupEnv(name)
+	if !ok || p == "" {
+		return "", fmt.Errorf("Environment variable %s for the storage password is not set", name)
+	}
+	return p, nil
+}
+
+// passwordFromFile reads the storage password from the first line of a file,
+// which should be readable only by its owner.
+func passwordFromFile(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		log.Printf("Warning: storage password file %s is accessible by other users\n", path)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	p := strings.SplitN(string(b), "\n", 2)[0]
+	if p == "" {
+		return "", fmt.Errorf("Storage password file %s is empty", path)
+	}
+	return p, nil
+}
+
+// passwordFromKeyring reads the storage password from the OS keyring,
+// using the security tool on OS X and secret-tool from libsecret elsewhere.
+func passwordFromKeyring(service, account string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	case "windows":
+		return "", fmt.Errorf("Keyring storage passwords are not supported on %s", runtime.GOOS)
+	default:
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Could not read the storage password from the keyring: %s", err)
+	}
+	p := strings.TrimRight(string(out), "\n")
+	if p == "" {
+		return "", fmt.Errorf("The keyring holds an empty storage password for %s", account)
+	}
+	return p, nil
+}
+
+// EnvPassword returns a Client.StoragePasswordProvider reading the
+// password from the given environment variable.
+func EnvPassword(name string) func() (string, error) {
+	return func() (string, error) {
+		return passwordFromEnv(name)
+	}
+}
+
+// FilePassword returns a Client.StoragePasswordProvider reading the
+// password from the given file.
+func FilePassword(path string) func() (string, error) {
+	return func() (string, error) {
+		return passwordFromFile(path)
+	}
+}
+
+// KeyringPassword returns a Client.StoragePasswordProvider reading the
+// password stored in the OS keyring for the given service and account.
+func KeyringPassword(service, account string) func() (string, error) {
+	return func() (string, error) {
+		return passwordFromKeyring(service, account)
+	}
+}
+
+// storagePassword returns the password protecting the store, from the first
+// configured source: the config file, an environment variable, a file,
+// the OS keyring, and finally the client.
+func storagePassword() (string, error) {
+	switch {
+	case conf().StoragePassword != "":
+		return conf().StoragePassword, nil
+	case conf().StoragePasswordEnv != "":
+		return passwordFromEnv(conf().StoragePasswordEnv)
+	case conf().StoragePasswordFile != "":
+		return passwordFromFile(conf().StoragePasswordFile)
+	case conf().StoragePasswordKeyring != "":
+		return passwordFromKeyring(conf().StoragePasswordKeyring, conf().Tel)
+	}
+	return getStoragePassword()
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordProviders(t *testing.T) {
+	os.Setenv("TEXTSECURE_TEST_PASSWORD", "secret")
+	defer os.Unsetenv("TEXTSECURE_TEST_PASSWORD")
+	p, err := passwordFromEnv("TEXTSECURE_TEST_PASSWORD")
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", p)
+	_, err = passwordFromEnv("TEXTSECURE_TEST_PASSWORD_UNSET")
+	assert.Error(t, err)
+	os.Setenv("TEXTSECURE_TEST_PASSWORD_EMPTY", "")
+	defer os.Unsetenv("TEXTSECURE_TEST_PASSWORD_EMPTY")
+	_, err = EnvPassword("TEXTSECURE_TEST_PASSWORD_EMPTY")()
+	assert.Error(t, err, "an empty password is not a password")
+
+	dir, err := ioutil.TempDir("", "textsecure")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "password")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("secret\n"), 0600))
+	p, err = passwordFromFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", p)
+	_, err = passwordFromFile(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, []byte("\nsecret\n"), 0600))
+	_, err = FilePassword(path)()
+	assert.Error(t, err)
+}
+
+func TestStoragePasswordWithoutCallback(t *testing.T) {
+	config, client = &Config{}, &Client{}
+	defer func() { config, client = nil, nil }()
+
+	_, err := storagePassword()
+	assert.Equal(t, ErrNoStoragePassword, err)
+
+	client.ReadLine = func(prompt string) string { return "typed" }
+	p, err := storagePassword()
+	assert.NoError(t, err)
+	assert.Equal(t, "typed", p)
+
+	client.GetStoragePassword = func() string { return "secret" }
+	p, err = storagePassword()
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", p)
+
+	client.StoragePasswordProvider = EnvPassword("TEXTSECURE_TEST_PASSWORD_UNSET")
+	_, err = storagePassword()
+	assert.Error(t, err, "the provider's error is not turned into an empty password")
+}
+
+func TestEmptyStoragePassword(t *testing.T) {
+	defer setupTestStore(t)()
+	dir := storageDir
+	textSecureStore = nil
+	client = &Client{RootDir: dir, GetStoragePassword: func() string { return "" }}
+
+	assert.Equal(t, ErrNoStoragePassword, setupStore())
+	assert.Nil(t, textSecureStore, "no plaintext store is created")
+	_, err := os.Stat(filepath.Join(dir, ".storage"))
+	assert.True(t, os.IsNotExist(err))
+}
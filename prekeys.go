@@ -4,8 +4,14 @@
 package textsecure
 
 import (
+	"errors"
+	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zmanian/textsecure/axolotl"
@@ -76,18 +82,37 @@ var signedKey *axolotl.SignedPreKeyRecord
 
 var lastResortPreKeyID uint32 = 0xFFFFFF
 
-var preKeyBatchSize = 100
+const (
+	defaultPreKeyBatchSize = 100
+	// maxPreKeyBatchSize bounds the configured batch size, keeping uploads
+	// to a size the server accepts.
+	maxPreKeyBatchSize = 1000
+)
+
+// preKeyBatchSize returns the number of one-time prekeys kept on the server.
+func preKeyBatchSize() int {
+	if conf() != nil && conf().PreKeyBatchSize > 0 {
+		return conf().PreKeyBatchSize
+	}
+	return defaultPreKeyBatchSize
+}
 
 func getNextPreKeyID() uint32 {
 	return randID()
 }
 
+// preKeyID returns the ID of the i-th prekey of a batch starting at startID,
+// wrapping around so that one-time prekeys stay between 1 and lastResortPreKeyID-1.
+func preKeyID(startID uint32, i int) uint32 {
+	return (startID+uint32(i))%(lastResortPreKeyID-1) + 1
+}
+
 func generatePreKeys() error {
 	os.MkdirAll(textSecureStore.preKeysDir, 0700)
 
 	startID := getNextPreKeyID()
-	for i := 0; i < preKeyBatchSize; i++ {
-		err := generatePreKey(startID + uint32(i))
+	for i := 0; i < preKeyBatchSize(); i++ {
+		err := generatePreKey(preKeyID(startID, i))
 		if err != nil {
 			return err
 		}
@@ -97,6 +122,7 @@ func generatePreKeys() error {
 		return err
 	}
 	signedKey = generateSignedPreKey()
+	textSecureStore.setCurrentSignedPreKeyID(*signedKey.Spkrs.Id)
 	return nil
 }
 
@@ -111,23 +137,206 @@ func generateSignedPreKey() *axolotl.SignedPreKeyRecord {
 	randBytes(random[:])
 	priv := identityKey.PrivateKey.Key()
 	signature := curve25519sign.Sign(priv, kp.PublicKey.Serialize(), random)
-	record := axolotl.NewSignedPreKeyRecord(id, uint64(time.Now().UnixNano()*1000), kp, signature[:])
+	record := axolotl.NewSignedPreKeyRecord(id, uint64(clock().Now().UnixNano()/int64(time.Millisecond)), kp, signature[:])
 	textSecureStore.StoreSignedPreKey(id, record)
 	return record
 }
 
+// The signed prekey is replaced every signedPreKeyRotationInterval,
+// and replaced ones are kept for signedPreKeyMaxAge so in-flight messages
+// encrypted to them can still be decrypted.
+const (
+	signedPreKeyRotationInterval = 48 * time.Hour
+	signedPreKeyMaxAge           = 14 * 24 * time.Hour
+)
+
+// signedPreKeyTime returns the creation time of a signed prekey.
+func signedPreKeyTime(record *axolotl.SignedPreKeyRecord) time.Time {
+	ms := int64(record.Spkrs.GetTimestamp())
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+// SignedPreKeyAge returns how long ago the current signed prekey was generated.
+func SignedPreKeyAge() (time.Duration, error) {
+	id, err := textSecureStore.currentSignedPreKeyID()
+	if err != nil {
+		return 0, err
+	}
+	record, err := textSecureStore.LoadSignedPreKey(id)
+	if err != nil {
+		return 0, err
+	}
+	return since(signedPreKeyTime(record)), nil
+}
+
+// RotateSignedPreKey generates a new signed prekey and uploads it to the server,
+// then removes the previous ones which are older than signedPreKeyMaxAge.
+func RotateSignedPreKey() error {
+	record := generateSignedPreKey()
+	id := *record.Spkrs.Id
+	err := registerSignedPreKey(generateSignedPreKeyEntity(record))
+	if err != nil {
+		textSecureStore.RemoveSignedPreKey(id)
+		return err
+	}
+	textSecureStore.setCurrentSignedPreKeyID(id)
+
+	for _, old := range textSecureStore.LoadSignedPreKeys() {
+		oldID := old.Spkrs.GetId()
+		if oldID != id && since(signedPreKeyTime(&old)) > signedPreKeyMaxAge {
+			textSecureStore.RemoveSignedPreKey(oldID)
+		}
+	}
+	return nil
+}
+
+// rotation holds the channels of the running signed prekey rotator, if any.
+var rotation struct {
+	sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startSignedPreKeyRotation starts rotating the signed prekey in the background,
+// replacing the rotator started by a previous Setup.
+func startSignedPreKeyRotation() {
+	stopSignedPreKeyRotation()
+	rotation.Lock()
+	defer rotation.Unlock()
+	rotation.stop = make(chan struct{})
+	rotation.done = make(chan struct{})
+	go rotateSignedPreKeys(rotation.stop, rotation.done)
+}
+
+// stopSignedPreKeyRotation stops the background rotator and waits for it to exit.
+func stopSignedPreKeyRotation() {
+	rotation.Lock()
+	defer rotation.Unlock()
+	if rotation.stop == nil {
+		return
+	}
+	close(rotation.stop)
+	<-rotation.done
+	rotation.stop, rotation.done = nil, nil
+}
+
+// rotateSignedPreKeys periodically checks the age of the signed prekey
+// and rotates it when it gets older than signedPreKeyRotationInterval,
+// until stop is closed.
+func rotateSignedPreKeys(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	for {
+		age, err := SignedPreKeyAge()
+		if err != nil || age < 0 || age > signedPreKeyRotationInterval {
+			err = RotateSignedPreKey()
+			if err != nil {
+				log.Println("Could not rotate signed prekey:", err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-clock().After(time.Hour):
+		}
+	}
+}
+
+// preKeyMinimum is the number of one-time prekeys left on the server
+// below which a new batch is uploaded.
+const preKeyMinimum = 10
+
+// preKeyRefreshJitter bounds the random delay before replenishing prekeys,
+// so that clients running out at the same time do not all refill at once.
+const preKeyRefreshJitter = 5 * time.Minute
+
+// preKeysNeeded returns how many one-time prekeys to generate to bring
+// the count left on the server back up to a full batch.
+func preKeysNeeded(count int) int {
+	n := preKeyBatchSize() - count
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// RefreshPreKeys tops up the one-time prekeys to a full batch and uploads them,
+// together with the current signed prekey, so peers can keep starting sessions.
+// One-time prekeys are removed from the store as soon as a peer uses them.
+func RefreshPreKeys() error {
+	count, err := PreKeyCount()
+	if err != nil {
+		return err
+	}
+	return refreshPreKeys(currentTransport(), count)
+}
+
+// refreshPreKeys is RefreshPreKeys for an account with count one-time prekeys
+// left on the server, uploading through t.
+func refreshPreKeys(t transporter, count int) error {
+	id, err := textSecureStore.currentSignedPreKeyID()
+	if err != nil {
+		return err
+	}
+	signedKey, err = textSecureStore.LoadSignedPreKey(id)
+	if err != nil {
+		return err
+	}
+	n := preKeysNeeded(count)
+	startID := getNextPreKeyID()
+	for i := 0; i < n; i++ {
+		err := generatePreKey(preKeyID(startID, i))
+		if err != nil {
+			return err
+		}
+	}
+	err = generatePreKeyState()
+	if err != nil {
+		return err
+	}
+	return registerPreKeys2(t)
+}
+
+var refreshingPreKeys int32
+
+// replenishPreKeys uploads new prekeys if the server is running out of them.
+// It is called whenever a peer used one of our prekeys to start a session.
+func replenishPreKeys() {
+	if !atomic.CompareAndSwapInt32(&refreshingPreKeys, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&refreshingPreKeys, 0)
+
+	count, err := PreKeyCount()
+	if err != nil {
+		log.Println("Could not get the prekey count:", err)
+		return
+	}
+	if count >= preKeyMinimum {
+		return
+	}
+	clock().Sleep(time.Duration(rand.Int63n(int64(preKeyRefreshJitter))))
+	err = RefreshPreKeys()
+	if err != nil {
+		log.Println("Could not refresh prekeys:", err)
+	}
+}
+
 func generatePreKeyState() error {
 	err := loadPreKeys()
 	if err != nil {
 		return err
 	}
-	preKeys = &preKeyState{}
-	npkr := len(preKeyRecords)
-	preKeys.PreKeys = make([]*preKeyEntity, npkr-1)
-	for i := range preKeys.PreKeys {
-		preKeys.PreKeys[i] = generatepreKeyEntity(preKeyRecords[i])
+	preKeys = &preKeyState{PreKeys: []*preKeyEntity{}}
+	for _, record := range preKeyRecords {
+		if *record.Pkrs.Id == lastResortPreKeyID {
+			preKeys.LastResortKey = generatepreKeyEntity(record)
+		} else {
+			preKeys.PreKeys = append(preKeys.PreKeys, generatepreKeyEntity(record))
+		}
+	}
+	if preKeys.LastResortKey == nil {
+		return errors.New("No last resort prekey in the store")
 	}
-	preKeys.LastResortKey = generatepreKeyEntity(preKeyRecords[npkr-1])
 	preKeys.IdentityKey = base64EncWithoutPadding(identityKey.PublicKey.Serialize())
 	preKeys.SignedPreKey = generateSignedPreKeyEntity(signedKey)
 	return nil
@@ -137,7 +346,8 @@ func loadPreKeys() error {
 	preKeyRecords = []*axolotl.PreKeyRecord{}
 	count := 0
 	err := filepath.Walk(textSecureStore.preKeysDir, func(path string, fi os.FileInfo, err error) error {
-		if !fi.IsDir() {
+		// skip temporary files left behind by an interrupted write
+		if !fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
 			preKeyRecords = append(preKeyRecords, &axolotl.PreKeyRecord{}) //FIXME
 			_, fname := filepath.Split(path)
 			id, err := filenameToID(fname)
@@ -0,0 +1,110 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zmanian/textsecure/axolotl"
+)
+
+// okTransport accepts every request, standing in for the server.
+type okTransport struct{}
+
+func (okTransport) get(url string) (*response, error) {
+	return &response{Status: 200}, nil
+}
+
+func (okTransport) putJSON(url string, body []byte) (*response, error) {
+	return &response{Status: 200}, nil
+}
+
+func (okTransport) putBinary(url string, body []byte) (*response, error) {
+	return &response{Status: 200}, nil
+}
+
+func (okTransport) del(url string) (*response, error) {
+	return &response{Status: 200}, nil
+}
+
+func TestDecryptAfterSignedPreKeyRotation(t *testing.T) {
+	defer setupTestStore(t)()
+	peerStore, err := newStore("", storageDir+"/peer")
+	assert.NoError(t, err)
+	transport = okTransport{}
+
+	identityKey = axolotl.GenerateIdentityKeyPair()
+	assert.NoError(t, textSecureStore.SetIdentityKeyPair(identityKey))
+	textSecureStore.SetLocalRegistrationID(1)
+	assert.NoError(t, peerStore.SetIdentityKeyPair(axolotl.GenerateIdentityKeyPair()))
+	peerStore.SetLocalRegistrationID(2)
+
+	assert.NoError(t, RotateSignedPreKey())
+	oldID, err := textSecureStore.currentSignedPreKeyID()
+	assert.NoError(t, err)
+	spk, err := textSecureStore.LoadSignedPreKey(oldID)
+	assert.NoError(t, err)
+	assert.NoError(t, generatePreKey(7))
+	pk, err := textSecureStore.LoadPreKey(7)
+	assert.NoError(t, err)
+
+	// the peer encrypts to the signed prekey it fetched before the rotation
+	pkb, err := axolotl.NewPreKeyBundle(1, 1, 7, axolotl.NewECPublicKey(pk.Pkrs.PublicKey),
+		int32(oldID), axolotl.NewECPublicKey(spk.Spkrs.PublicKey), spk.Spkrs.Signature, &identityKey.PublicKey)
+	assert.NoError(t, err)
+	sb := axolotl.NewSessionBuilder(peerStore, peerStore, peerStore, peerStore, "self", 1)
+	assert.NoError(t, sb.BuildSenderSession(pkb))
+	sc := axolotl.NewSessionCipher(peerStore, peerStore, peerStore, peerStore, "self", 1)
+	ct, _, err := sc.SessionEncryptMessage([]byte("hello"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, RotateSignedPreKey())
+	newID, err := textSecureStore.currentSignedPreKeyID()
+	assert.NoError(t, err)
+	assert.NotEqual(t, oldID, newID)
+
+	pkwm, err := axolotl.LoadPreKeyWhisperMessage(ct)
+	assert.NoError(t, err)
+	assert.Equal(t, oldID, pkwm.SignedPreKeyID)
+	b, err := sessionCipher("peer", 1).SessionDecryptPreKeyWhisperMessage(pkwm)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	assert.False(t, textSecureStore.ContainsPreKey(7), "used one-time prekey must be removed")
+}
+
+func TestPreKeysNeeded(t *testing.T) {
+	assert.Equal(t, preKeyBatchSize(), preKeysNeeded(0))
+	assert.Equal(t, preKeyBatchSize()-7, preKeysNeeded(7))
+	assert.Equal(t, 0, preKeysNeeded(preKeyBatchSize()))
+	assert.Equal(t, 0, preKeysNeeded(preKeyBatchSize()+1))
+}
+
+func TestPreKeyIDs(t *testing.T) {
+	for _, start := range []uint32{0, 1, lastResortPreKeyID - 1, lastResortPreKeyID} {
+		for i := 0; i < maxPreKeyBatchSize; i++ {
+			id := preKeyID(start, i)
+			assert.True(t, id > 0 && id < lastResortPreKeyID, "prekey ID %d out of range", id)
+		}
+	}
+}
+
+func TestLastResortPreKey(t *testing.T) {
+	defer setupTestStore(t)()
+	identityKey = axolotl.GenerateIdentityKeyPair()
+	signedKey = generateSignedPreKey()
+
+	// an ID past the last resort one, as generated before IDs wrapped around,
+	// is stored after it
+	for _, id := range []uint32{5, lastResortPreKeyID, lastResortPreKeyID + 1} {
+		assert.NoError(t, generatePreKey(id))
+	}
+	assert.NoError(t, generatePreKeyState())
+	assert.Equal(t, lastResortPreKeyID, preKeys.LastResortKey.ID)
+	ids := []uint32{}
+	for _, pk := range preKeys.PreKeys {
+		ids = append(ids, pk.ID)
+	}
+	assert.Equal(t, []uint32{5, lastResortPreKeyID + 1}, ids)
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// netDialer returns the dialer opening the TCP connections to the server, through
+// the proxy in config.Proxy if set. TLS is layered on top of these connections,
+// so the server's key is pinned end to end and the proxy only sees ciphertext.
+func netDialer() (dialer, error) {
+	if conf() == nil || conf().Proxy == "" {
+		return net.Dial, nil
+	}
+	u, err := url.Parse(conf().Proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: pass}
+		}
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return d.Dial, nil
+	case "http":
+		return connectDialer(u), nil
+	}
+	return nil, fmt.Errorf("Unsupported proxy scheme %s", u.Scheme)
+}
+
+// connectDialer returns a dialer tunneling connections through an HTTP proxy with CONNECT.
+func connectDialer(u *url.URL) dialer {
+	return func(network, addr string) (net.Conn, error) {
+		c, err := net.Dial(network, u.Host)
+		if err != nil {
+			return nil, err
+		}
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			creds := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pass))
+			req.Header.Set("Proxy-Authorization", "Basic "+creds)
+		}
+		err = req.Write(c)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(c), req)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			c.Close()
+			return nil, fmt.Errorf("Proxy refused the connection to %s: %s", addr, resp.Status)
+		}
+		return c, nil
+	}
+}
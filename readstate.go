@@ -0,0 +1,122 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// MessageRef identifies a received message by its sender and timestamp.
+type MessageRef struct {
+	Source    string `yaml:"source"`
+	Timestamp uint64 `yaml:"timestamp"`
+}
+
+// readState keeps the messages passed to the client which it has not marked as read.
+// It is saved in the store, so it survives restarts.
+var readState = struct {
+	sync.Mutex
+	path   string
+	unread map[MessageRef]bool
+}{unread: make(map[MessageRef]bool)}
+
+// setupReadState loads the unread messages from the store.
+func setupReadState() error {
+	readState.Lock()
+	defer readState.Unlock()
+	readState.path = filepath.Join(storageDir, "unread")
+	readState.unread = make(map[MessageRef]bool)
+	b, err := textSecureStore.readFile(readState.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	refs := []MessageRef{}
+	err = yaml.Unmarshal(b, &refs)
+	if err != nil {
+		return err
+	}
+	for _, r := range refs {
+		readState.unread[r] = true
+	}
+	return nil
+}
+
+// saveReadState writes the unread messages to the store, with readState locked.
+func saveReadState() error {
+	b, err := yaml.Marshal(sortedRefs())
+	if err != nil {
+		return err
+	}
+	return textSecureStore.writeFile(readState.path, b)
+}
+
+// sortedRefs returns the unread messages oldest first, with readState locked.
+func sortedRefs() []MessageRef {
+	refs := make([]MessageRef, 0, len(readState.unread))
+	for r := range readState.unread {
+		refs = append(refs, r)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Timestamp != refs[j].Timestamp {
+			return refs[i].Timestamp < refs[j].Timestamp
+		}
+		return refs[i].Source < refs[j].Source
+	})
+	return refs
+}
+
+// maxUnreadMessages bounds the unread messages remembered, the oldest being
+// forgotten first, as the whole set is saved on every change.
+var maxUnreadMessages = 1000
+
+// markUnread records a message passed to the MessageHandler, if read state tracking is enabled.
+func markUnread(msg *Message) error {
+	if !conf().TrackReadState {
+		return nil
+	}
+	readState.Lock()
+	defer readState.Unlock()
+	r := MessageRef{msg.source, msg.timestamp}
+	if readState.unread[r] {
+		return nil
+	}
+	readState.unread[r] = true
+	if excess := len(readState.unread) - maxUnreadMessages; excess > 0 {
+		for _, old := range sortedRefs()[:excess] {
+			delete(readState.unread, old)
+		}
+	}
+	return saveReadState()
+}
+
+// MarkRead records that the client acted on the message from source with the
+// given timestamp, so it is no longer returned by UnreadMessages.
+func MarkRead(source string, timestamp uint64) error {
+	readState.Lock()
+	defer readState.Unlock()
+	r := MessageRef{source, timestamp}
+	if !readState.unread[r] {
+		return nil
+	}
+	delete(readState.unread, r)
+	return saveReadState()
+}
+
+// UnreadMessages returns the received messages not yet marked as read, oldest first.
+// Messages are only tracked when Config.TrackReadState is set, once they pass
+// the client middleware and are handed to the MessageHandler, and only the
+// latest 1000 of them are kept.
+func UnreadMessages() []MessageRef {
+	readState.Lock()
+	defer readState.Unlock()
+	return sortedRefs()
+}
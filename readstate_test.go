@@ -0,0 +1,47 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadState(t *testing.T) {
+	defer setupTestStore(t)()
+	config = &Config{TrackReadState: true}
+
+	assert.NoError(t, setupReadState())
+	assert.Empty(t, UnreadMessages())
+	assert.NoError(t, markUnread(&Message{source: "+1", timestamp: 2}))
+	assert.NoError(t, markUnread(&Message{source: "+2", timestamp: 1}))
+	assert.NoError(t, markUnread(&Message{source: "+1", timestamp: 2}))
+	assert.Equal(t, []MessageRef{{"+2", 1}, {"+1", 2}}, UnreadMessages())
+
+	// the state survives a restart
+	assert.NoError(t, MarkRead("+2", 1))
+	assert.NoError(t, MarkRead("+3", 1))
+	assert.NoError(t, setupReadState())
+	assert.Equal(t, []MessageRef{{"+1", 2}}, UnreadMessages())
+
+	// messages dropped by the middleware are not tracked
+	client = &Client{
+		Middleware:     []func(*Message) bool{func(msg *Message) bool { return msg.source != "+3" }},
+		MessageHandler: func(*Message) {},
+	}
+	defer func() { client = nil }()
+	dispatchMessage(&Message{source: "+3", timestamp: 3})
+	assert.Equal(t, []MessageRef{{"+1", 2}}, UnreadMessages())
+
+	// the oldest messages are forgotten past the limit
+	defer func(max int) { maxUnreadMessages = max }(maxUnreadMessages)
+	maxUnreadMessages = 10
+	for i := 0; i < maxUnreadMessages; i++ {
+		assert.NoError(t, markUnread(&Message{source: "+2", timestamp: uint64(10 + i)}))
+	}
+	unread := UnreadMessages()
+	assert.Len(t, unread, maxUnreadMessages)
+	assert.Equal(t, MessageRef{"+2", 10}, unread[0])
+}
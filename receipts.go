@@ -0,0 +1,74 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zmanian/textsecure/protobuf"
+)
+
+// receiptKey identifies a sent message by its recipient and timestamp,
+// which is how delivery receipts refer to it.
+type receiptKey struct {
+	tel       string
+	timestamp uint64
+}
+
+var (
+	receiptWaitersMu sync.Mutex
+	receiptWaiters   = make(map[receiptKey]chan struct{})
+)
+
+func handleReceipt(ipms *textsecure.IncomingPushMessageSignal) {
+	key := receiptKey{ipms.GetSource(), ipms.GetTimestamp()}
+	receiptWaitersMu.Lock()
+	if ch, ok := receiptWaiters[key]; ok {
+		close(ch)
+		delete(receiptWaiters, key)
+	}
+	receiptWaitersMu.Unlock()
+
+	if client.ReceiptHandler != nil {
+		client.ReceiptHandler(ipms.GetSource(), ipms.GetTimestamp())
+	}
+}
+
+// ErrReceiptTimeout is returned by SendMessageAndWait when no delivery
+// receipt arrived in time. The message may still have been delivered.
+var ErrReceiptTimeout = errors.New("Timed out waiting for the delivery receipt")
+
+// SendMessageAndWait sends a text message and blocks until the recipient's
+// delivery receipt arrives or the timeout elapses.
+// Receipts are only seen while messages are being received, with
+// ListenForMessages running or Poll being called.
+func SendMessageAndWait(tel, msg string, timeout time.Duration) error {
+	tel, err := normalizeRecipient(tel)
+	if err != nil {
+		return err
+	}
+	key := receiptKey{tel, makeTimestamp()}
+	ch := make(chan struct{})
+	receiptWaitersMu.Lock()
+	receiptWaiters[key] = ch
+	receiptWaitersMu.Unlock()
+	defer func() {
+		receiptWaitersMu.Lock()
+		delete(receiptWaiters, key)
+		receiptWaitersMu.Unlock()
+	}()
+
+	err = SendMessageWithTimestamp(tel, msg, key.timestamp)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-clock().After(timeout):
+		return ErrReceiptTimeout
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"log"
+	"sync"
+
+	"github.com/zmanian/textsecure/protobuf"
+)
+
+// decryptionFailures counts the consecutive messages from each peer device
+// that could not be decrypted.
+var decryptionFailures = struct {
+	sync.Mutex
+	m map[cipherKey]int
+}{m: make(map[cipherKey]int)}
+
+// trackDecryption records the outcome of decrypting an envelope. After
+// config.MaxDecryptionFailures consecutive failures from the same device,
+// the session with it is assumed to be out of sync and is reset.
+func trackDecryption(ipms *textsecure.IncomingPushMessageSignal, err error) {
+	typ := ipms.GetType()
+	if typ != textsecure.IncomingPushMessageSignal_CIPHERTEXT && typ != textsecure.IncomingPushMessageSignal_PREKEY_BUNDLE {
+		return
+	}
+	recid, rerr := recID(ipms.GetSource())
+	if rerr != nil {
+		return
+	}
+	k := cipherKey{recid, ipms.GetSourceDevice()}
+
+	decryptionFailures.Lock()
+	if err == nil {
+		delete(decryptionFailures.m, k)
+		decryptionFailures.Unlock()
+		return
+	}
+	decryptionFailures.m[k]++
+	reset := conf().MaxDecryptionFailures > 0 && decryptionFailures.m[k] >= conf().MaxDecryptionFailures
+	if reset {
+		delete(decryptionFailures.m, k)
+	}
+	decryptionFailures.Unlock()
+
+	lerr := logDecryptionFailure(DecryptionFailure{
+		Source:    ipms.GetSource(),
+		Device:    ipms.GetSourceDevice(),
+		Timestamp: ipms.GetTimestamp(),
+		Error:     err.Error(),
+	})
+	if lerr != nil {
+		log.Println(lerr)
+	}
+	if reset {
+		log.Printf("Resetting the session with device %d of %s after repeated decryption failures\n", k.deviceID, ipms.GetSource())
+		if rerr := resetDeviceSession(ipms.GetSource(), k.recipientID, k.deviceID); rerr != nil {
+			log.Println(rerr)
+		}
+	}
+	if client.DecryptionErrorHandler != nil {
+		client.DecryptionErrorHandler(ipms.GetSource(), ipms.GetSourceDevice(), err, reset)
+	}
+}
+
+// ResetSession resets the secure session with a contact, as when the user asks for
+// it after messages failed to decrypt: the sessions with each of the contact's
+// devices are archived and an end session message is sent to them, so both sides
+// start a new session with the next message.
+func ResetSession(tel string) error {
+	tel, err := normalizeRecipient(tel)
+	if err != nil {
+		return err
+	}
+	recid, err := recID(tel)
+	if err != nil {
+		return err
+	}
+	devs := textSecureStore.GetSubDeviceSessions(recid)
+	if len(devs) == 0 {
+		devs = []uint32{1}
+	}
+	for _, d := range devs {
+		err = resetDeviceSession(tel, recid, d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endSession archives the sessions with a contact who sent an end session message,
+// so the next message to it starts a new session.
+func endSession(tel string) {
+	recid, err := recID(tel)
+	if err != nil {
+		return
+	}
+	textSecureStore.DeleteAllSessions(recid)
+}
+
+// resetDeviceSession archives the session with a peer device and sends it an end
+// session message in a new prekey session, so both sides start afresh with the
+// next message. If the server refuses the message for a single device, with
+// ErrSingleDeviceRejected, only the local session is archived.
+func resetDeviceSession(tel, recid string, deviceID uint32) error {
+	textSecureStore.DeleteSession(recid, deviceID)
+	err := sendMessage(&outgoingMessage{
+		tel:    tel,
+		device: deviceID,
+		flags:  uint32(textsecure.PushMessageContent_END_SESSION),
+	})
+	// the peer drops its sessions on receiving the end session message
+	textSecureStore.DeleteSession(recid, deviceID)
+	return err
+}
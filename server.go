@@ -8,9 +8,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/zmanian/textsecure/axolotl"
+	"github.com/zmanian/textsecure/curve25519sign"
 	"github.com/zmanian/textsecure/protobuf"
 )
 
@@ -21,21 +28,31 @@ type RegistrationInfo struct {
 	password       string
 	registrationID uint32
 	signalingKey   []byte
+	uuid           string // assigned by the server on registration, if it supports UUIDs
 }
 
 var registrationInfo RegistrationInfo
 
+// UUID returns the account UUID the server assigned on registration,
+// or an empty string if the server predates UUID addressing.
+func UUID() string {
+	return registrationInfo.uuid
+}
+
 // Registration
 
 func requestCode(tel, method string) (string, error) {
-	resp, err := transport.get(fmt.Sprintf("/v1/accounts/%s/code/%s", method, tel))
+	resp, err := currentTransport().get(fmt.Sprintf(endpoints().RequestCode, method, tel))
 	if err != nil {
 		return "", err
 	}
+	if resp.isError() {
+		return "", resp
+	}
 	// unofficial dev method, useful for development, with no telephony account needed on the server
 	if method == "dev" {
 		code := make([]byte, 7)
-		_, err = resp.Body.Read(code)
+		_, err = io.ReadFull(resp.Body, code)
 		if err != nil {
 			return "", err
 		}
@@ -49,20 +66,160 @@ type verificationData struct {
 	RegistrationID  uint32 `json:"registrationId"`
 	SupportsSms     bool   `json:"supportSms"`
 	FetchesMessages bool   `json:"fetchesMessages"`
+	Pin             string `json:"pin,omitempty"`
+
+	Capabilities              map[string]bool `json:"capabilities,omitempty"`
+	DiscoverableByPhoneNumber bool            `json:"discoverableByPhoneNumber"`
 }
 
-func verifyCode(code string) error {
-	vd := verificationData{
+// accountAttributes returns the attributes of our account sent to the server
+// with the given config.
+func accountAttributes(cfg *Config, pin string) *verificationData {
+	return &verificationData{
 		SignalingKey:    base64.StdEncoding.EncodeToString(registrationInfo.signalingKey),
 		SupportsSms:     false,
 		FetchesMessages: true,
 		RegistrationID:  registrationInfo.registrationID,
+		Pin:             pin,
+		Capabilities:    cfg.Capabilities,
+
+		DiscoverableByPhoneNumber: !cfg.Undiscoverable,
+	}
+}
+
+// UpdateAccountAttributes sends the attributes of our account to the server again,
+// so changes to the advertised capabilities take effect without registering anew.
+func UpdateAccountAttributes() error {
+	return updateAccountAttributes(conf())
+}
+
+func updateAccountAttributes(cfg *Config) error {
+	body, err := json.Marshal(accountAttributes(cfg, ""))
+	if err != nil {
+		return err
+	}
+	resp, err := currentTransport().putJSON(endpoints().AccountAttributes, body)
+	if err != nil {
+		return err
 	}
-	body, err := json.Marshal(vd)
+	if resp.isError() {
+		return resp
+	}
+	return nil
+}
+
+// DiscoverableByPhoneNumber reports whether others can find the account
+// by looking up its phone number, as with GetRegisteredContacts.
+func DiscoverableByPhoneNumber() bool {
+	return !conf().Undiscoverable
+}
+
+// SetDiscoverableByPhoneNumber changes whether others can find the account
+// by looking up its phone number, updating the account attributes on the server.
+// The setting is not written to the config file, so undiscoverable should be set
+// there too for it to survive a new registration.
+func SetDiscoverableByPhoneNumber(discoverable bool) error {
+	// the config is replaced rather than modified, as other goroutines may be reading it
+	newCfg := *conf()
+	newCfg.Undiscoverable = !discoverable
+	err := updateAccountAttributes(&newCfg)
 	if err != nil {
 		return err
 	}
-	resp, err := transport.putJSON("/v1/accounts/code/"+code, body)
+	setConfig(&newCfg)
+	return nil
+}
+
+// ErrRegistrationLocked is returned, wrapped in a RegistrationLockedError, when the
+// number is protected by a registration lock PIN which was not supplied or was wrong.
+var ErrRegistrationLocked = errors.New("Registration locked, the PIN is required")
+
+// RegistrationLockedError reports a registration lock on the number, with the time
+// left before the lock expires and the number can be registered without the PIN.
+type RegistrationLockedError struct {
+	TimeRemaining time.Duration
+}
+
+func (err RegistrationLockedError) Error() string {
+	return fmt.Sprintf("%s (lock expires in %s)", ErrRegistrationLocked, err.TimeRemaining)
+}
+
+// Is makes errors.Is match RegistrationLockedError against ErrRegistrationLocked.
+func (err RegistrationLockedError) Is(target error) bool {
+	return target == ErrRegistrationLocked
+}
+
+// jsonRegistrationLock is the body of a 423 response to a verification
+type jsonRegistrationLock struct {
+	TimeRemaining int64 `json:"timeRemaining"`
+}
+
+// jsonVerifyResponse is the body of a successful verification,
+// empty with servers predating UUID addressing.
+type jsonVerifyResponse struct {
+	UUID string `json:"uuid"`
+}
+
+// verifyCode completes the registration with the received code, and the
+// registration lock PIN if the number is locked, returning the account UUID
+// assigned by the server, if any. The request is sent through t, which
+// authenticates as the number being registered.
+func verifyCode(t transporter, code, pin string) (string, error) {
+	body, err := json.Marshal(accountAttributes(conf(), pin))
+	if err != nil {
+		return "", err
+	}
+	resp, err := t.putJSON(fmt.Sprintf(endpoints().VerifyCode, code), body)
+	if err != nil {
+		return "", err
+	}
+	if resp.Status == 423 {
+		rl := &jsonRegistrationLock{}
+		if resp.Body != nil {
+			json.NewDecoder(resp.Body).Decode(rl)
+		}
+		return "", RegistrationLockedError{time.Duration(rl.TimeRemaining) * time.Millisecond}
+	}
+	if resp.isError() {
+		return "", resp
+	}
+	return parseVerifyResponse(resp), nil
+}
+
+// parseVerifyResponse returns the account UUID from the body of a successful
+// verification, ignoring bodies without a valid one.
+func parseVerifyResponse(resp *response) string {
+	if resp.Body == nil {
+		return ""
+	}
+	vr := &jsonVerifyResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(vr); err != nil || !uuidRegexp.MatchString(vr.UUID) {
+		return ""
+	}
+	return strings.ToLower(vr.UUID)
+}
+
+type jsonRegistrationLockPin struct {
+	Pin string `json:"pin"`
+}
+
+// SetRegistrationLockPin protects the number with a registration lock, so
+// registering it again requires the PIN until the lock expires after a week
+// of inactivity. An empty PIN removes the lock.
+// Only the PIN based lock of the TextSecure server is supported, not keeping
+// the master key with a secure value recovery service.
+func SetRegistrationLockPin(pin string) error {
+	var resp *response
+	var err error
+	if pin == "" {
+		resp, err = currentTransport().del(endpoints().RegistrationLock)
+	} else {
+		body, jerr := json.Marshal(&jsonRegistrationLockPin{pin})
+		if jerr != nil {
+			return jerr
+		}
+		resp, err = currentTransport().putJSON(endpoints().RegistrationLock, body)
+	}
 	if err != nil {
 		return err
 	}
@@ -73,13 +230,52 @@ func verifyCode(code string) error {
 }
 
 // PUT /v2/keys/
-func registerPreKeys2() error {
+func registerPreKeys2(t transporter) error {
 	body, err := json.MarshalIndent(preKeys, "", "")
 	if err != nil {
 		return err
 	}
 
-	resp, err := transport.putJSON("/v2/keys/", body)
+	resp, err := t.putJSON(endpoints().Keys, body)
+	if err != nil {
+		return err
+	}
+	if resp.isError() {
+		return resp
+	}
+	return nil
+}
+
+type jsonPreKeyCount struct {
+	Count int `json:"count"`
+}
+
+// PreKeyCount returns the number of one-time prekeys left on the server,
+// for monitoring how fast an account uses them up.
+// GET /v2/keys
+func PreKeyCount() (int, error) {
+	resp, err := currentTransport().get(endpoints().KeyCount)
+	if err != nil {
+		return 0, err
+	}
+	if resp.isError() {
+		return 0, resp
+	}
+	c := &jsonPreKeyCount{}
+	err = json.NewDecoder(resp.Body).Decode(c)
+	if err != nil {
+		return 0, err
+	}
+	return c.Count, nil
+}
+
+// PUT /v2/keys/signed
+func registerSignedPreKey(spk *signedPreKeyEntity) error {
+	body, err := json.Marshal(spk)
+	if err != nil {
+		return err
+	}
+	resp, err := currentTransport().putJSON(endpoints().SignedKey, body)
 	if err != nil {
 		return err
 	}
@@ -90,14 +286,19 @@ func registerPreKeys2() error {
 }
 
 // GET /v2/keys/{number}/{device_id}?relay={relay}
-func getPreKeys(tel string) (*preKeyResponse, error) {
-	resp, err := transport.get(fmt.Sprintf("/v2/keys/%s/*", tel))
+func getPreKeys(tel string, deviceID string) (*preKeyResponse, error) {
+	resp, err := currentTransport().get(fmt.Sprintf(endpoints().PeerKeys, tel, deviceID))
 	if err != nil {
 		return nil, err
 	}
+	// the caller decides whether the number or only the requested device is unknown
+	if resp.Status == 404 {
+		return nil, ErrRecipientNotRegistered
+	}
 	if resp.isError() {
 		return nil, fmt.Errorf("HTTP error %d\n", resp.Status)
 	}
+	clearUnregistered(tel)
 	dec := json.NewDecoder(resp.Body)
 	k := &preKeyResponse{}
 	dec.Decode(k)
@@ -111,28 +312,18 @@ type jsonContact struct {
 	SupportsSms bool   `json:"supportsSms"`
 }
 
-// GetRegisteredContacts returns the subset of the local contacts
-// that are also registered with the server
-func GetRegisteredContacts() ([]Contact, error) {
-	lc, err := loadLocalContacts()
-	if err != nil {
-		return nil, fmt.Errorf("Could not get local contacts :%s\n", err)
-	}
-	tokens := make([]string, len(lc))
-	m := make(map[string]Contact)
-	for i, c := range lc {
-		t := telToToken(c.Tel)
-		tokens[i] = t
-		m[t] = c
-	}
+// directoryBatchSize is the maximum number of tokens sent in one directory request
+const directoryBatchSize = 1000
 
+// intersectContacts returns the tokens of the given ones which belong to registered users
+func intersectContacts(tokens []string) ([]jsonContact, error) {
 	contacts := make(map[string][]string)
 	contacts["contacts"] = tokens
 	body, err := json.MarshalIndent(contacts, "", "    ")
 	if err != nil {
 		return nil, err
 	}
-	resp, err := transport.putJSON("/v1/directory/tokens/", body)
+	resp, err := currentTransport().putJSON(endpoints().DirectoryTokens, body)
 	if err != nil {
 		return nil, err
 	}
@@ -142,10 +333,71 @@ func GetRegisteredContacts() ([]Contact, error) {
 	dec := json.NewDecoder(resp.Body)
 	var jc map[string][]jsonContact
 	dec.Decode(&jc)
+	return jc["contacts"], nil
+}
+
+// GetRegisteredContactsStream calls f for each of the local contacts
+// that are also registered with the server, stopping early if f returns false.
+// The directory is queried in batches, so large address books can be processed incrementally.
+// Lookups are cached for Config.DirectoryCacheTTL seconds, an hour by default.
+func GetRegisteredContactsStream(f func(Contact) bool) error {
+	return registeredContactsStream(f, false)
+}
+
+// registeredContactsStream implements GetRegisteredContactsStream,
+// bypassing the directory cache if force is set.
+func registeredContactsStream(f func(Contact) bool, force bool) error {
+	lc, err := loadLocalContacts()
+	if err != nil {
+		return fmt.Errorf("Could not get local contacts :%s\n", err)
+	}
+	for start := 0; start < len(lc); start += directoryBatchSize {
+		end := start + directoryBatchSize
+		if end > len(lc) {
+			end = len(lc)
+		}
+		tokens := make([]string, 0, end-start)
+		m := make(map[string]Contact)
+		for _, c := range lc[start:end] {
+			t := telToToken(c.Tel)
+			tokens = append(tokens, t)
+			m[t] = c
+		}
+
+		jc, err := cachedIntersectContacts(tokens, force)
+		if err != nil {
+			return err
+		}
+		for _, c := range jc {
+			if !f(m[c.Token]) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// GetRegisteredContacts returns the subset of the local contacts
+// that are also registered with the server.
+// Lookups are cached for Config.DirectoryCacheTTL seconds, an hour by default.
+func GetRegisteredContacts() ([]Contact, error) {
+	return registeredContacts(false)
+}
+
+// RefreshRegisteredContacts is like GetRegisteredContacts, but queries the server
+// for all the local contacts, for when fresh results are really needed.
+func RefreshRegisteredContacts() ([]Contact, error) {
+	return registeredContacts(true)
+}
 
-	lc = make([]Contact, len(jc["contacts"]))
-	for i, c := range jc["contacts"] {
-		lc[i] = m[c.Token]
+func registeredContacts(force bool) ([]Contact, error) {
+	lc := []Contact{}
+	err := registeredContactsStream(func(c Contact) bool {
+		lc = append(lc, c)
+		return true
+	}, force)
+	if err != nil {
+		return nil, err
 	}
 	return lc, nil
 }
@@ -158,12 +410,12 @@ type jsonAllocation struct {
 }
 
 func confirmReceipt(source string, timestamp uint64) {
-	transport.putJSON(fmt.Sprintf("/v1/receipt/%s/%d", source, timestamp), nil)
+	currentTransport().putJSON(fmt.Sprintf(endpoints().Receipt, source, timestamp), nil)
 }
 
 // GET /v1/attachments/
 func allocateAttachment() (uint64, string, error) {
-	resp, err := transport.get("/v1/attachments")
+	resp, err := currentTransport().get(endpoints().Attachments)
 	if err != nil {
 		return 0, "", err
 	}
@@ -174,7 +426,7 @@ func allocateAttachment() (uint64, string, error) {
 }
 
 func getAttachmentLocation(id uint64) (string, error) {
-	resp, err := transport.get(fmt.Sprintf("/v1/attachments/%d", id))
+	resp, err := currentTransport().get(fmt.Sprintf(endpoints().Attachment, id))
 	if err != nil {
 		return "", err
 	}
@@ -192,6 +444,65 @@ type jsonMessage struct {
 	DestRegistrationID uint32 `json:"destinationRegistrationId"`
 	Body               string `json:"body"`
 	Relay              string `json:"relay,omitempty"`
+	Silent             bool   `json:"silent,omitempty"`
+}
+
+// jsonQueuedMessage is a message waiting in the server queue, as returned by GET /v1/messages
+type jsonQueuedMessage struct {
+	Type         int32  `json:"type"`
+	Relay        string `json:"relay"`
+	Timestamp    uint64 `json:"timestamp"`
+	Source       string `json:"source"`
+	SourceDevice uint32 `json:"sourceDevice"`
+	Message      []byte `json:"message"`
+}
+
+// envelope converts a queued message to the structure received over the websocket.
+func (m *jsonQueuedMessage) envelope() *textsecure.IncomingPushMessageSignal {
+	typ := textsecure.IncomingPushMessageSignal_Type(m.Type)
+	return &textsecure.IncomingPushMessageSignal{
+		Type:         &typ,
+		Source:       &m.Source,
+		SourceDevice: &m.SourceDevice,
+		Relay:        &m.Relay,
+		Timestamp:    &m.Timestamp,
+		Message:      m.Message,
+	}
+}
+
+// GET /v1/messages/
+func fetchMessages() ([]jsonQueuedMessage, error) {
+	resp, err := currentTransport().get(endpoints().Messages)
+	if err != nil {
+		return nil, err
+	}
+	if resp.isError() {
+		return nil, resp
+	}
+	defer resp.Body.Close()
+	var ml struct {
+		Messages []jsonQueuedMessage `json:"messages"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&ml)
+	if err != nil {
+		return nil, err
+	}
+	return ml.Messages, nil
+}
+
+// AckMessage removes a message fetched over HTTP from the server queue,
+// so it is not delivered again. It is the REST counterpart of the websocket
+// acknowledgement and is called by ReceiveMessages once a message is handled.
+// DELETE /v1/messages/{source}/{timestamp}
+func AckMessage(source string, timestamp uint64) error {
+	resp, err := currentTransport().del(fmt.Sprintf(endpoints().DeleteMessage, source, timestamp))
+	if err != nil {
+		return err
+	}
+	if resp.isError() {
+		return resp
+	}
+	return nil
 }
 
 func createMessage(msg *outgoingMessage) ([]byte, error) {
@@ -199,13 +510,20 @@ func createMessage(msg *outgoingMessage) ([]byte, error) {
 	if msg.msg != "" {
 		pmc.Body = &msg.msg
 	}
-	if msg.attachment != nil {
-		pmc.Attachments = []*textsecure.PushMessageContent_AttachmentPointer{
-			&textsecure.PushMessageContent_AttachmentPointer{
-				Id:          &msg.attachment.id,
-				ContentType: &msg.attachment.ct,
-				Key:         msg.attachment.keys,
-			},
+	for _, a := range msg.attachments {
+		pmc.Attachments = append(pmc.Attachments, &textsecure.PushMessageContent_AttachmentPointer{
+			Id:          &a.id,
+			ContentType: &a.ct,
+			Key:         a.keys,
+		})
+	}
+	if msg.flags != 0 {
+		pmc.Flags = &msg.flags
+	}
+	if msg.sync != nil {
+		pmc.Sync = &textsecure.PushMessageContent_SyncMessageContext{
+			Destination: &msg.sync.destination,
+			Timestamp:   &msg.sync.timestamp,
 		}
 	}
 	if msg.group != nil {
@@ -241,20 +559,51 @@ func stripPadding(msg []byte) []byte {
 	return msg
 }
 
-func makePreKeyBundle(tel string) (*axolotl.PreKeyBundle, error) {
-	pkr, err := getPreKeys(tel)
+// ErrInvalidSignedPreKey is returned when a fetched prekey bundle contains a signed
+// prekey which is not signed by the recipient's identity key.
+var ErrInvalidSignedPreKey = errors.New("Signed prekey signature does not match the identity key")
+
+// verifySignedPreKey checks that the signed prekey was signed by the identity key,
+// so a session is never built with a signed prekey injected by the server.
+func verifySignedPreKey(identityKey, signedPreKey, signature []byte) error {
+	var ik [32]byte
+	var sig [64]byte
+	copy(ik[:], identityKey)
+	copy(sig[:], signature)
+	spk := axolotl.NewECPublicKey(signedPreKey)
+	if !curve25519sign.Verify(ik, spk.Serialize(), &sig) {
+		return ErrInvalidSignedPreKey
+	}
+	return nil
+}
+
+// makePreKeyBundle fetches the prekeys of the given device of a recipient.
+func makePreKeyBundle(tel string, deviceID uint32) (*axolotl.PreKeyBundle, error) {
+	pkr, err := getPreKeys(tel, strconv.FormatUint(uint64(deviceID), 10))
 	if err != nil {
 		return nil, err
 	}
 
 	ndev := len(pkr.Devices)
+	if ndev == 0 {
+		return nil, fmt.Errorf("No prekeys available for %s", tel)
+	}
 
 	pkbs := make([]*axolotl.PreKeyBundle, ndev)
 
 	for i, d := range pkr.Devices {
-		decPK, err := decodeKey(d.PreKey.PublicKey)
-		if err != nil {
-			return nil, err
+		if d.SignedPreKey == nil {
+			return nil, fmt.Errorf("No signed prekey for device %d of %s", d.DeviceID, tel)
+		}
+		// without one-time prekeys left, the session is built from the signed prekey only
+		var preKeyID uint32
+		var preKey *axolotl.ECPublicKey
+		if d.PreKey != nil {
+			decPK, err := decodeKey(d.PreKey.PublicKey)
+			if err != nil {
+				return nil, err
+			}
+			preKeyID, preKey = d.PreKey.ID, axolotl.NewECPublicKey(decPK)
 		}
 
 		decSPK, err := decodeKey(d.SignedPreKey.PublicKey)
@@ -272,62 +621,199 @@ func makePreKeyBundle(tel string) (*axolotl.PreKeyBundle, error) {
 			return nil, err
 		}
 
+		err = verifySignedPreKey(decIK, decSPK, decSig)
+		if err != nil {
+			return nil, err
+		}
+
 		pkbs[i], err = axolotl.NewPreKeyBundle(
-			d.RegistrationID, d.DeviceID, d.PreKey.ID,
-			axolotl.NewECPublicKey(decPK), int32(d.SignedPreKey.ID), axolotl.NewECPublicKey(decSPK),
+			d.RegistrationID, d.DeviceID, preKeyID,
+			preKey, int32(d.SignedPreKey.ID), axolotl.NewECPublicKey(decSPK),
 			decSig, axolotl.NewIdentityKey(decIK))
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return pkbs[0], nil
+	for _, pkb := range pkbs {
+		if pkb.DeviceID == deviceID {
+			return pkb, nil
+		}
+	}
+	return nil, fmt.Errorf("No prekeys available for device %d of %s", deviceID, tel)
 }
 
-type att struct {
+// AttachmentPointer refers to an attachment uploaded to the server, together with
+// the keys to decrypt it. It can be sent in any number of messages.
+type AttachmentPointer struct {
 	id   uint64
 	ct   string
 	keys []byte
 }
 
+// ContentType returns the content type the attachment was uploaded with.
+func (a *AttachmentPointer) ContentType() string {
+	return a.ct
+}
+
+// startSession builds a session with the given device of a recipient from its prekeys.
+func startSession(tel, recid string, devid uint32) error {
+	pkb, err := makePreKeyBundle(tel, devid)
+	if err != nil {
+		return err
+	}
+	sb := axolotl.NewSessionBuilder(textSecureStore, textSecureStore, textSecureStore, textSecureStore, recid, pkb.DeviceID)
+	return sb.BuildSenderSession(pkb)
+}
+
+// buildMessage encrypts the message for each of its destination devices.
 func buildMessage(msg *outgoingMessage) ([]jsonMessage, error) {
-	devid := uint32(1) //FIXME: support multiple destination devices
 	paddedMessage, err := createMessage(msg)
 	if err != nil {
 		return nil, err
 	}
-	recid := recID(msg.tel)
-	if !textSecureStore.ContainsSession(recid, devid) {
-		pkb, err := makePreKeyBundle(msg.tel)
+	recid, err := recID(msg.tel)
+	if err != nil {
+		return nil, err
+	}
+	messages := []jsonMessage{}
+	for _, devid := range msg.destinationDevices(recid) {
+		if !textSecureStore.ContainsSession(recid, devid) {
+			err := startSession(msg.tel, recid, devid)
+			if err == ErrRecipientNotRegistered {
+				// only a peer's default device missing means the number is not registered
+				if msg.device != 0 || msg.tel == conf().Tel {
+					return nil, fmt.Errorf("Device %d of %s is not registered", devid, msg.tel)
+				}
+				markUnregistered(msg.tel)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if client.OutgoingHook != nil {
+			client.OutgoingHook(msg.tel, devid, paddedMessage)
+		}
+		sc := sessionCipher(recid, devid)
+		encryptedMessage, messageType, err := sc.SessionEncryptMessage(paddedMessage)
 		if err != nil {
 			return nil, err
 		}
-		sb := axolotl.NewSessionBuilder(textSecureStore, textSecureStore, textSecureStore, textSecureStore, recid, pkb.DeviceID)
-		err = sb.BuildSenderSession(pkb)
+		if client.OutgoingCiphertextHook != nil {
+			client.OutgoingCiphertextHook(msg.tel, devid, encryptedMessage)
+		}
+
+		rrID, err := sc.GetRemoteRegistrationID()
 		if err != nil {
 			return nil, err
 		}
+		messages = append(messages, jsonMessage{
+			Type:               messageType,
+			DestDeviceID:       devid,
+			DestRegistrationID: rrID,
+			Body:               base64.StdEncoding.EncodeToString(encryptedMessage),
+			Silent:             msg.silent,
+		})
 	}
-	sc := axolotl.NewSessionCipher(textSecureStore, textSecureStore, textSecureStore, textSecureStore, recid, devid)
-	encryptedMessage, messageType, err := sc.SessionEncryptMessage(paddedMessage)
-	if err != nil {
-		return nil, err
+	return messages, nil
+}
+
+// destinationDevices returns the devices the message is encrypted for:
+// the one it is addressed to, or else the recipient's default device
+// together with the other devices we have sessions with.
+func (msg *outgoingMessage) destinationDevices(recid string) []uint32 {
+	devid := msg.destinationDevice()
+	devs := []uint32{devid}
+	if msg.device != 0 {
+		return devs
+	}
+	for _, d := range textSecureStore.GetSubDeviceSessions(recid) {
+		if d != devid {
+			devs = append(devs, d)
+		}
 	}
+	return devs
+}
 
-	rrID, err := sc.GetRemoteRegistrationID()
-	if err != nil {
-		return nil, err
+// destinationDevice returns the device the message is addressed to, the default one if unset.
+func (msg *outgoingMessage) destinationDevice() uint32 {
+	if msg.device == 0 {
+		return 1
 	}
-	messages := []jsonMessage{{
-		Type:               messageType,
-		DestDeviceID:       devid,
-		DestRegistrationID: rrID,
-		Body:               base64.StdEncoding.EncodeToString(encryptedMessage),
-	}}
-	return messages, nil
+	return msg.device
+}
+
+// sendRetries is how many times a send failing at the transport level is retried
+const sendRetries = 2
+
+// makeTimestamp returns the current time in milliseconds since the epoch
+func makeTimestamp() uint64 {
+	return uint64(clock().Now().UnixNano() / int64(time.Millisecond))
+}
+
+// isTransportError reports whether the error happened before getting an HTTP response,
+// in which case the server may or may not have accepted the message.
+func isTransportError(err error) bool {
+	_, ok := err.(*url.Error)
+	return ok
 }
 
+// sendMessage is the single path all outgoing messages take, so retries and
+// the handling of stale or mismatched devices apply to every kind of message.
 func sendMessage(msg *outgoingMessage) error {
+	if len(msg.msg) > maxMessageLength() {
+		return ErrMessageTooLong
+	}
+	if msg.timestamp == 0 {
+		msg.timestamp = makeTimestamp()
+	}
+	if isNoteToSelf(msg) {
+		// there is no session with ourselves, our other devices get it as a sent transcript
+		msg.tel = conf().Tel
+		return sendTranscripts(msg)
+	}
+	start := clock().Now()
+	var err error
+	// Retries keep the timestamp, so the recipient can drop the duplicate if the first attempt went through
+	mismatchRetried := false
+	for i := 0; i <= sendRetries; i++ {
+		err = deliverMessage(msg)
+		if (err == ErrStaleDevices || err == ErrMismatchedDevices) && !mismatchRetried {
+			// the sessions were brought in line with the recipient's devices, so sending again can succeed
+			mismatchRetried = true
+			i--
+			continue
+		}
+		if err == nil || !isTransportError(err) {
+			break
+		}
+	}
+	if err != nil {
+		metrics().IncCounter(MetricSendFailures)
+		return err
+	}
+	metrics().IncCounter(MetricMessagesSent)
+	metrics().ObserveLatency(MetricSendLatency, since(start))
+	// the message was delivered, so failing to transcribe it is not an error for the caller
+	if err := sendSyncTranscript(msg); err != nil {
+		log.Printf("Could not send a transcript to our linked devices: %s\n", err)
+	}
+	return nil
+}
+
+// deliverMessage encrypts a message and sends it to the server.
+func deliverMessage(msg *outgoingMessage) error {
+	tel, err := normalizeRecipient(msg.tel)
+	if err != nil {
+		return err
+	}
+	msg.tel = tel
+	if knownUnregistered(tel) {
+		return ErrRecipientNotRegistered
+	}
+	// concurrent sends to the same peer must not interleave updates of its sessions
+	defer lockRecipient(tel)()
+
 	m := make(map[string]interface{})
 	bm, err := buildMessage(msg)
 	if err != nil {
@@ -335,20 +821,102 @@ func sendMessage(msg *outgoingMessage) error {
 	}
 	m["messages"] = bm
 	m["destination"] = msg.tel
+	m["timestamp"] = msg.timestamp
 	body, err := json.MarshalIndent(m, "", "    ")
 	if err != nil {
 		return err
 	}
-	resp, err := transport.putJSON("/v1/messages/"+msg.tel, body)
+	resp, err := currentTransport().putJSON(fmt.Sprintf(endpoints().Message, msg.tel), body)
 	if err != nil {
 		return err
 	}
-	if resp.Status == 410 {
-		textSecureStore.DeleteSession(recID(msg.tel), uint32(1))
-		return errors.New("The remote device is gone (probably reinstalled)")
+	if resp.Status == 404 {
+		markUnregistered(tel)
+		return ErrRecipientNotRegistered
+	}
+	if resp.Status == 409 || resp.Status == 410 {
+		return handleDeviceMismatch(msg, resp)
 	}
 	if resp.isError() {
 		return resp
 	}
+	clearUnregistered(tel)
+	msg.needsSync = needsSync(resp)
 	return nil
 }
+
+// jsonSendMessageResponse is the body of a successful send
+type jsonSendMessageResponse struct {
+	NeedsSync bool `json:"needsSync"`
+}
+
+// needsSync reports whether the server asked, in the body of a successful send,
+// for a transcript of the message to be sent to our linked devices.
+func needsSync(resp *response) bool {
+	if resp.Body == nil {
+		return false
+	}
+	r := &jsonSendMessageResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+		return false
+	}
+	return r.NeedsSync
+}
+
+// ErrStaleDevices is returned when the recipient's device was reinstalled or
+// re-registered, so the session with it is no longer valid.
+var ErrStaleDevices = errors.New("The remote device is gone (probably reinstalled)")
+
+// ErrMismatchedDevices is returned when the server reports the message was not
+// addressed to the recipient's current set of devices.
+var ErrMismatchedDevices = errors.New("The message does not match the recipient's devices")
+
+// ErrSingleDeviceRejected is returned when a message addressed to a single device
+// is refused because the recipient has other devices, as the server only accepts
+// messages encrypted for all of them.
+var ErrSingleDeviceRejected = errors.New("The server requires the message for all of the recipient's devices")
+
+// jsonMismatchedDevices is the body of a 409 response to a send
+type jsonMismatchedDevices struct {
+	MissingDevices []uint32 `json:"missingDevices"`
+	ExtraDevices   []uint32 `json:"extraDevices"`
+	StaleDevices   []uint32 `json:"staleDevices"`
+}
+
+// handleDeviceMismatch deletes the sessions with the devices the server
+// reported as stale (410) or no longer existing (409), so the next send
+// builds fresh sessions from the recipient's current prekeys, and starts
+// sessions with the devices it reported missing (409), so the next send
+// includes them.
+func handleDeviceMismatch(msg *outgoingMessage, resp *response) error {
+	recid, err := recID(msg.tel)
+	if err != nil {
+		return err
+	}
+	md := &jsonMismatchedDevices{}
+	if resp.Body != nil {
+		json.NewDecoder(resp.Body).Decode(md)
+	}
+	if resp.Status == 410 {
+		if len(md.StaleDevices) == 0 {
+			md.StaleDevices = []uint32{msg.destinationDevice()}
+		}
+		for _, d := range md.StaleDevices {
+			textSecureStore.DeleteSession(recid, d)
+		}
+		return ErrStaleDevices
+	}
+	for _, d := range md.ExtraDevices {
+		textSecureStore.DeleteSession(recid, d)
+	}
+	if msg.device != 0 && len(md.MissingDevices) > 0 {
+		// sessions with the other devices would not make the server accept a message for one
+		return ErrSingleDeviceRejected
+	}
+	for _, d := range md.MissingDevices {
+		if err := startSession(msg.tel, recid, d); err != nil {
+			return err
+		}
+	}
+	return ErrMismatchedDevices
+}
@@ -32,6 +32,7 @@ type store struct {
 	sessionsDir      string
 
 	unencrypted bool
+	noFsync     bool // skip fsyncing writes, for deployments accepting weaker durability
 	aesKey      []byte
 	macKey      []byte
 }
@@ -46,6 +47,7 @@ func newStore(password, path string) (*store, error) {
 	}
 
 	// Create dirs in case this is first run
+	os.MkdirAll(path, 0700)
 	os.MkdirAll(ts.preKeysDir, 0700)
 	os.MkdirAll(ts.signedPreKeysDir, 0700)
 	os.MkdirAll(ts.identityDir, 0700)
@@ -61,7 +63,7 @@ func newStore(password, path string) (*store, error) {
 		// Create salt if this is first run
 		if !exists(saltFile) {
 			randBytes(salt)
-			err = ioutil.WriteFile(saltFile, salt, 0600)
+			err = writeFileAtomic(saltFile, salt, true)
 			if err != nil {
 				return nil, err
 			}
@@ -158,7 +160,30 @@ func (s *store) writeFile(path string, b []byte) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path, b, 0600)
+	return writeFileAtomic(path, b, !s.noFsync)
+}
+
+// writeFileAtomic replaces the file at path with b, readable only by its owner.
+// The contents are written to a temporary file which is renamed over path,
+// so a crash never leaves a truncated file behind, and are flushed to disk
+// first if sync is set.
+func writeFileAtomic(path string, b []byte, sync bool) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
 }
 
 // Identity store
@@ -185,16 +210,32 @@ func (s *store) GetIdentityKeyPair() (*axolotl.IdentityKeyPair, error) {
 	return axolotl.NewIdentityKeyPairFromKeys(b[32:], b[:32]), nil
 }
 
-func (s *store) GetUserIdentityKeyPair(id string) *axolotl.IdentityKeyPair {
+// loadRemoteIdentity returns the trusted identity key of a peer.
+func (s *store) loadRemoteIdentity(id string) (*axolotl.IdentityKey, error) {
 	idkeyfile := filepath.Join(s.identityDir, "remote_"+id)
-	if !exists(idkeyfile) {
-		panic("id key not found")
-	}
 	b, err := s.readFile(idkeyfile)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("Identity key for %s is %d not 32 bytes long", id, len(b))
+	}
+	return axolotl.NewIdentityKey(b), nil
+}
+
+// remoteIdentities returns the IDs of all peers with a trusted identity key.
+func (s *store) remoteIdentities() ([]string, error) {
+	files, err := ioutil.ReadDir(s.identityDir)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), "remote_") {
+			ids = append(ids, strings.TrimPrefix(fi.Name(), "remote_"))
+		}
 	}
-	return axolotl.NewIdentityKeyPairFromKeys(b[32:], b[:32])
+	return ids, nil
 }
 
 func (s *store) SetIdentityKeyPair(ikp *axolotl.IdentityKeyPair) error {
@@ -207,20 +248,30 @@ func (s *store) SetIdentityKeyPair(ikp *axolotl.IdentityKeyPair) error {
 
 func (s *store) SaveIdentity(id string, key *axolotl.IdentityKey) error {
 	idkeyfile := filepath.Join(s.identityDir, "remote_"+id)
+	forgetSessionCiphers(id)
 	return s.writeFile(idkeyfile, key.Key()[:])
 }
 
 func (s *store) IsTrustedIdentity(id string, key *axolotl.IdentityKey) bool {
 	idkeyfile := filepath.Join(s.identityDir, "remote_"+id)
-	// Trust on first use (TOFU)
-	if !exists(idkeyfile) {
-		return true
+	known := exists(idkeyfile)
+	if known {
+		b, err := s.readFile(idkeyfile)
+		if err != nil {
+			return false
+		}
+		if bytes.Equal(b, key.Key()[:]) {
+			return true
+		}
 	}
-	b, err := s.readFile(idkeyfile)
-	if err != nil {
+	switch decideTrust(id, key, !known) {
+	case TrustAccept:
+		return true
+	case TrustReject:
 		return false
 	}
-	return bytes.Equal(b, key.Key()[:])
+	// Trust on first use (TOFU)
+	return !known
 }
 
 // Prekey and signed prekey store
@@ -263,10 +314,33 @@ func (s *store) LoadSignedPreKey(id uint32) (*axolotl.SignedPreKeyRecord, error)
 
 func (s *store) LoadSignedPreKeys() []axolotl.SignedPreKeyRecord {
 	keys := []axolotl.SignedPreKeyRecord{}
-	//FIXME
+	files, err := ioutil.ReadDir(s.signedPreKeysDir)
+	if err != nil {
+		return keys
+	}
+	for _, fi := range files {
+		id, err := filenameToID(fi.Name())
+		if err != nil {
+			continue
+		}
+		record, err := s.LoadSignedPreKey(id)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, *record)
+	}
 	return keys
 }
 
+// currentSignedPreKeyID returns the ID of the signed prekey last uploaded to the server.
+func (s *store) currentSignedPreKeyID() (uint32, error) {
+	return s.readNumFromFile(filepath.Join(s.identityDir, "signed_prekey_id"))
+}
+
+func (s *store) setCurrentSignedPreKeyID(id uint32) {
+	s.writeNumToFile(filepath.Join(s.identityDir, "signed_prekey_id"), id)
+}
+
 func (s *store) StorePreKey(id uint32, record *axolotl.PreKeyRecord) error {
 	b, err := record.Serialize()
 	if err != nil {
@@ -337,23 +411,61 @@ func (s *store) loadHTTPSignalingKey() ([]byte, error) {
 	return b, nil
 }
 
+// storeRegisteredTel records the number the installation successfully registered.
+func (s *store) storeRegisteredTel(tel string) {
+	telFile := filepath.Join(s.identityDir, "registered_tel")
+	s.writeFile(telFile, []byte(tel))
+}
+
+// storeUUID records the account UUID assigned by the server on registration.
+func (s *store) storeUUID(uuid string) {
+	uuidFile := filepath.Join(s.identityDir, "uuid")
+	s.writeFile(uuidFile, []byte(uuid))
+}
+
+func (s *store) loadUUID() string {
+	uuidFile := filepath.Join(s.identityDir, "uuid")
+	b, err := s.readFile(uuidFile)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func (s *store) loadRegisteredTel() string {
+	telFile := filepath.Join(s.identityDir, "registered_tel")
+	b, err := s.readFile(telFile)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
 // Session store
 
 func (s *store) sessionFilePath(recipientID string, deviceID uint32) string {
 	return filepath.Join(s.sessionsDir, fmt.Sprintf("%s_%d", recipientID, deviceID))
 }
 
+// GetSubDeviceSessions returns the IDs of the devices of a peer we have sessions with.
 func (s *store) GetSubDeviceSessions(recipientID string) []uint32 {
 	sessions := []uint32{}
 
-	filepath.Walk(s.sessionsDir, func(path string, fi os.FileInfo, err error) error {
-		if !fi.IsDir() {
-			i := strings.LastIndex(path, "_")
-			id, _ := strconv.Atoi(path[i+1:])
-			sessions[len(sessions)] = uint32(id)
+	files, err := ioutil.ReadDir(s.sessionsDir)
+	if err != nil {
+		return sessions
+	}
+	prefix := recipientID + "_"
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), prefix) {
+			continue
+		}
+		id, err := strconv.Atoi(fi.Name()[len(prefix):])
+		if err != nil {
+			continue
 		}
-		return nil
-	})
+		sessions = append(sessions, uint32(id))
+	}
 	return sessions
 }
 
@@ -388,9 +500,11 @@ func (s *store) ContainsSession(recipientID string, deviceID uint32) bool {
 func (s *store) DeleteSession(recipientID string, deviceID uint32) {
 	sfile := s.sessionFilePath(recipientID, deviceID)
 	_ = os.Remove(sfile)
+	forgetSessionCipher(recipientID, deviceID)
 }
 
 func (s *store) DeleteAllSessions(recipientID string) {
+	defer forgetSessionCiphers(recipientID)
 	sessions := s.GetSubDeviceSessions(recipientID)
 	for _, dev := range sessions {
 		_ = os.Remove(s.sessionFilePath(recipientID, dev))
@@ -399,15 +513,38 @@ func (s *store) DeleteAllSessions(recipientID string) {
 
 var textSecureStore *store
 
+// ErrNoStoragePassword is returned when the store is encrypted but neither the config
+// nor the client provide a non-empty password, instead of silently leaving it unencrypted.
+var ErrNoStoragePassword = errors.New("No storage password configured, set unencryptedStorage to store keys in plaintext")
+
+// getStoragePassword asks the client's StoragePasswordProvider or GetStoragePassword
+// for the password protecting the store, falling back to ReadLine if no dedicated callback is set.
+func getStoragePassword() (string, error) {
+	if client.StoragePasswordProvider != nil {
+		return client.StoragePasswordProvider()
+	}
+	if client.GetStoragePassword != nil {
+		return client.GetStoragePassword(), nil
+	}
+	if client.ReadLine != nil {
+		return client.ReadLine("Input storage password>"), nil
+	}
+	return "", ErrNoStoragePassword
+}
+
 func setupStore() error {
 	var err error
 	storageDir = filepath.Join(client.RootDir, ".storage")
 
 	password := ""
-	if !config.UnencryptedStorage {
-		password = config.StoragePassword
+	if !conf().UnencryptedStorage {
+		password, err = storagePassword()
+		if err != nil {
+			return err
+		}
+		// newStore takes an empty password to mean plaintext storage
 		if password == "" {
-			password = client.GetStoragePassword()
+			return ErrNoStoragePassword
 		}
 	}
 
@@ -415,8 +552,13 @@ func setupStore() error {
 	if err != nil {
 		return err
 	}
+	textSecureStore.noFsync = conf().NoFsync
 
 	setupGroups()
 
-	return nil
+	err = setupFailureLog()
+	if err != nil {
+		return err
+	}
+	return setupReadState()
 }
@@ -0,0 +1,64 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupTestStore makes the package use a store in a new temporary directory,
+// with an empty config and client, and returns a function removing the
+// directory and resetting the globals the tests set.
+func setupTestStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "textsecure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageDir = dir
+	textSecureStore, err = newStore("secret", dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	config, client = &Config{}, &Client{}
+	return func() {
+		config, client, transport, textSecureStore, identityKey = nil, nil, nil, nil, nil
+		storageDir = ""
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStoreWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "textsecure")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "storage")
+	s, err := newStore("secret", root)
+	assert.NoError(t, err)
+
+	fi, err := os.Stat(root)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+
+	for _, noFsync := range []bool{false, true} {
+		s.noFsync = noFsync
+		path := filepath.Join(s.identityDir, "regid")
+		assert.NoError(t, s.writeFile(path, []byte("1234")))
+		b, err := s.readFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "1234", string(b))
+		fi, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	files, err := ioutil.ReadDir(s.identityDir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1, "no temporary files may be left behind")
+}
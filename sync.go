@@ -0,0 +1,100 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+// syncContext tells our other devices where and when a transcribed message was sent.
+type syncContext struct {
+	destination string
+	timestamp   uint64
+}
+
+// ownDeviceID is the device ID of this installation, which registers as the primary device.
+const ownDeviceID = 1
+
+// linkedDevices returns the IDs of our other devices, from the sessions we have
+// with them or, if there are none yet, from the server.
+func linkedDevices() ([]uint32, error) {
+	recid, err := recID(conf().Tel)
+	if err != nil {
+		return nil, err
+	}
+	devs := textSecureStore.GetSubDeviceSessions(recid)
+	if len(devs) == 0 {
+		pkr, err := getPreKeys(conf().Tel, "*")
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range pkr.Devices {
+			devs = append(devs, d.DeviceID)
+		}
+	}
+	linked := []uint32{}
+	for _, d := range devs {
+		if d != ownDeviceID {
+			linked = append(linked, d)
+		}
+	}
+	return linked, nil
+}
+
+// sendSyncTranscript sends a copy of a message we sent to our linked devices, so they
+// show it too. It is done when config.SendSyncTranscripts is set or the server
+// reported linked devices when accepting the message, unless the message opted out.
+func sendSyncTranscript(msg *outgoingMessage) error {
+	if !(conf().SendSyncTranscripts || msg.needsSync) || msg.noSync || msg.sync != nil || msg.flags != 0 || msg.tel == conf().Tel {
+		return nil
+	}
+	return sendTranscripts(msg)
+}
+
+// sendTranscripts sends a transcript of the message to each of our linked devices.
+func sendTranscripts(msg *outgoingMessage) error {
+	devs, err := linkedDevices()
+	if err != nil {
+		return err
+	}
+	for _, d := range devs {
+		t := &outgoingMessage{
+			tel:         conf().Tel,
+			msg:         msg.msg,
+			group:       msg.group,
+			attachments: msg.attachments,
+			timestamp:   msg.timestamp,
+			device:      d,
+			sync:        &syncContext{msg.tel, msg.timestamp},
+		}
+		err = sendMessage(t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isNoteToSelf reports whether a message is addressed to our own number,
+// rather than being a transcript for one of our linked devices.
+func isNoteToSelf(msg *outgoingMessage) bool {
+	if msg.sync != nil {
+		return false
+	}
+	tel, err := normalizeRecipient(msg.tel)
+	return err == nil && tel == conf().Tel
+}
+
+// SendToSelf sends a note to self, which shows up on all our linked devices.
+// It is the same as SendMessage with our own number.
+func SendToSelf(msg string) error {
+	return SendMessage(conf().Tel, msg)
+}
+
+// SendMessageWithoutSync is like SendMessage, but no transcript of the message is sent
+// to our linked devices, for automated replies which would only clutter them.
+func SendMessageWithoutSync(tel, msg string) error {
+	omsg := &outgoingMessage{
+		tel:    tel,
+		msg:    msg,
+		noSync: true,
+	}
+	return sendMessage(omsg)
+}
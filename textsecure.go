@@ -5,17 +5,25 @@
 package textsecure
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/zmanian/textsecure/axolotl"
 	"github.com/zmanian/textsecure/protobuf"
+	"io"
 	"log"
 	"mime"
+	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 // Generate a random 16 byte string used for HTTP Basic Authentication to the server
@@ -85,57 +93,222 @@ func needsRegistration() bool {
 var identityKey *axolotl.IdentityKeyPair
 
 type outgoingMessage struct {
-	tel        string
-	msg        string
-	group      *groupMessage
-	attachment *att
+	tel         string
+	msg         string
+	group       *groupMessage
+	attachments []*AttachmentPointer
+	timestamp   uint64
+	device      uint32 // destination device, 0 for the default one
+	flags       uint32
+	sync        *syncContext // set for transcripts sent to our linked devices
+	noSync      bool         // no transcript is sent to our linked devices
+	silent      bool         // the recipient is not sent a push notification
+	needsSync   bool         // the server reported we have linked devices to transcribe to
 }
 
 // SendMessage sends the given text message to the given contact.
 func SendMessage(tel, msg string) error {
+	return SendMessageWithTimestamp(tel, msg, makeTimestamp())
+}
+
+// SendMessageWithTimestamp sends the given text message with the given timestamp,
+// in milliseconds since the epoch. Resending a message whose send failed ambiguously
+// with its original timestamp lets the recipient recognize it as a duplicate.
+// If the message is longer than the configured maximum and splitLongMessages
+// is set, it is sent as several messages with consecutive timestamps.
+func SendMessageWithTimestamp(tel, msg string, timestamp uint64) error {
+	parts := []string{msg}
+	if conf().SplitLongMessages {
+		parts = splitMessage(msg, maxMessageLength())
+	}
+	for i, part := range parts {
+		omsg := &outgoingMessage{
+			tel:       tel,
+			msg:       part,
+			timestamp: timestamp + uint64(i),
+		}
+		err := sendMessage(omsg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrMessageTooLong is returned when a message body exceeds the maximum size
+// and splitting long messages is not enabled.
+var ErrMessageTooLong = errors.New("Message body too long")
+
+const defaultMaxMessageLength = 2000
+
+func maxMessageLength() int {
+	if conf().MaxMessageLength > 0 {
+		return conf().MaxMessageLength
+	}
+	return defaultMaxMessageLength
+}
+
+// splitMessage breaks a message into parts of at most max bytes,
+// preferring to break at whitespace and never splitting a UTF-8 sequence.
+// Whitespace around the breaks is dropped, so no part is empty.
+func splitMessage(msg string, max int) []string {
+	parts := []string{}
+	for len(msg) > max {
+		n := max
+		for n > 0 && !utf8.RuneStart(msg[n]) {
+			n--
+		}
+		if i := strings.LastIndexAny(msg[:n], " \n\t"); i > 0 {
+			n = i + 1
+		}
+		if n == 0 {
+			// a single rune longer than max, which only happens for tiny limits
+			_, n = utf8.DecodeRuneInString(msg)
+		}
+		if part := strings.TrimRight(msg[:n], " \n\t"); part != "" {
+			parts = append(parts, part)
+		}
+		// the whitespace at a break belongs to no part
+		msg = strings.TrimLeft(msg[n:], " \n\t")
+	}
+	if len(parts) > 0 && msg == "" {
+		return parts
+	}
+	return append(parts, msg)
+}
+
+// SendMessageToDevice sends the given text message only to the given device
+// of the contact, building a session with that device if needed.
+// It is meant for testing and for debugging a single linked device.
+// Servers which only accept messages for all the devices of a recipient refuse it
+// when the contact has other devices, and it fails with ErrSingleDeviceRejected.
+func SendMessageToDevice(tel string, deviceID uint32, msg string) error {
+	if deviceID == 0 {
+		return errors.New("Invalid device ID 0")
+	}
 	omsg := &outgoingMessage{
-		tel: tel,
-		msg: msg,
+		tel:    tel,
+		msg:    msg,
+		device: deviceID,
 	}
-	err := sendMessage(omsg)
-	if err != nil {
-		return err
+	return sendMessage(omsg)
+}
+
+// SendSilentMessage is like SendMessage, but asks the server not to send the recipient
+// a push notification, for bots updating state without buzzing the user's phone.
+// The message is delivered and acknowledged like any other.
+func SendSilentMessage(tel, msg string) error {
+	omsg := &outgoingMessage{
+		tel:    tel,
+		msg:    msg,
+		silent: true,
 	}
-	return nil
+	return sendMessage(omsg)
 }
 
 // SendFileAttachment sends the contents of a file, associated
 // with an optional message to a given contact.
 func SendFileAttachment(tel, msg string, path string) error {
+	return SendFileAttachmentWithType(tel, msg, path, "")
+}
+
+// SendFileAttachmentWithType is like SendFileAttachment, with the content type
+// of the attachment given explicitly. If it is empty, it is guessed from the
+// file extension or, failing that, from the contents of the file.
+func SendFileAttachmentWithType(tel, msg string, path string, ct string) error {
+	return SendFileAttachmentContext(context.Background(), tel, msg, path, ct)
+}
+
+// SendFileAttachmentContext is like SendFileAttachmentWithType, but cancelling
+// the context aborts the upload. The message is then not sent and the
+// context's error, such as context.Canceled, is returned.
+func SendFileAttachmentContext(ctx context.Context, tel, msg string, path string, ct string) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	ct := mime.TypeByExtension(filepath.Ext(path))
-	a, err := uploadAttachment(f, ct)
+	if ct == "" {
+		ct, err = fileContentType(f, path)
+		if err != nil {
+			return err
+		}
+	}
+	a, err := UploadAttachmentContext(ctx, f, ct)
 	if err != nil {
 		return err
 	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return SendMessageWithAttachments(tel, msg, []*AttachmentPointer{a})
+}
+
+// SendMessageWithAttachments sends a message with attachments uploaded
+// beforehand with UploadAttachment, so the same upload can be sent
+// to several contacts.
+func SendMessageWithAttachments(tel, msg string, atts []*AttachmentPointer) error {
 	omsg := &outgoingMessage{
-		tel:        tel,
-		msg:        msg,
-		attachment: a,
+		tel:         tel,
+		msg:         msg,
+		attachments: atts,
 	}
-	err = sendMessage(omsg)
+	return sendMessage(omsg)
+}
+
+// fileContentType guesses the content type of a file from its extension,
+// or by sniffing its first bytes for files without a known extension.
+func fileContentType(f *os.File, path string) (string, error) {
+	ct := mime.TypeByExtension(filepath.Ext(path))
+	if ct != "" {
+		return ct, nil
+	}
+	b := make([]byte, 512)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	_, err = f.Seek(0, 0)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return http.DetectContentType(b[:n]), nil
 }
 
+// MessageType identifies the kind of a received message.
+type MessageType int
+
+const (
+	// TextMessage carries a body and/or attachments.
+	TextMessage MessageType = iota
+	// GroupUpdateMessage creates a group or changes its name or members.
+	GroupUpdateMessage
+	// GroupQuitMessage notifies that the sender left the group.
+	GroupQuitMessage
+	// EndSessionMessage notifies that the sender ended the secure session.
+	EndSessionMessage
+	// SyncMessage is a copy of a message sent by another device of ours.
+	SyncMessage
+)
+
 // Message represents a message received from the peer.
 // It can optionally include attachments and be sent to a group.
 type Message struct {
-	source      string
-	message     string
-	attachments [][]byte
-	group       string
+	typ          MessageType
+	source       string
+	sourceDevice uint32
+	message      string
+	attachments  [][]byte
+	pointers     []*AttachmentPointer
+	skipped      []*AttachmentPointer
+	group        string
+	timestamp    uint64
+}
+
+// Type returns the kind of the message, so handlers can switch on it.
+func (m *Message) Type() MessageType {
+	return m.typ
 }
 
 // Source returns the ID of the sender of the message.
@@ -143,6 +316,11 @@ func (m *Message) Source() string {
 	return m.source
 }
 
+// SourceDevice returns the ID of the sender's device which sent the message.
+func (m *Message) SourceDevice() uint32 {
+	return m.sourceDevice
+}
+
 // Message returns the message body.
 func (m *Message) Message() string {
 	return m.message
@@ -153,19 +331,148 @@ func (m *Message) Attachments() [][]byte {
 	return m.attachments
 }
 
+// SkippedAttachments returns the attachments which were not downloaded, because
+// their content type is not allowed by the config or the download failed,
+// so they can still be reported and downloaded on demand.
+func (m *Message) SkippedAttachments() []*AttachmentPointer {
+	return m.skipped
+}
+
+// AttachmentPointers returns the pointers to all the attachments on the message,
+// whether they were downloaded or not.
+func (m *Message) AttachmentPointers() []*AttachmentPointer {
+	return m.pointers
+}
+
+// DownloadAttachment downloads again the attachment with the given index
+// in AttachmentPointers, to retry a download which failed.
+// What is read must be discarded unless reading reaches io.EOF.
+func (m *Message) DownloadAttachment(index int) (io.ReadCloser, error) {
+	if index < 0 || index >= len(m.pointers) {
+		return nil, fmt.Errorf("No attachment with index %d", index)
+	}
+	return m.pointers[index].Download()
+}
+
 // Group returns the group name or empty.
 func (m *Message) Group() string {
 	return m.group
 }
 
+// Timestamp returns the time the message was sent, in milliseconds since the epoch.
+func (m *Message) Timestamp() uint64 {
+	return m.timestamp
+}
+
+// Age returns how long ago the message was sent, according to its timestamp.
+// Messages may wait in the server queue for days while the client is offline.
+func (m *Message) Age() time.Duration {
+	sent := time.Unix(0, int64(m.timestamp)*int64(time.Millisecond))
+	return since(sent)
+}
+
+// IsFromSelf reports whether the message was sent by our own account, as a sync
+// transcript from a linked device or from our own number, so it is not mistaken
+// for an incoming message.
+func (m *Message) IsFromSelf() bool {
+	return m.typ == SyncMessage || (conf() != nil && m.source == conf().Tel)
+}
+
+// tooOld reports whether a message is older than config.MaxMessageAge
+// and must not be passed to the MessageHandler.
+func tooOld(msg *Message) bool {
+	if conf().MaxMessageAge <= 0 || msg.Age() <= time.Duration(conf().MaxMessageAge)*time.Second {
+		return false
+	}
+	log.Printf("Dropping message from %s sent %s ago\n", msg.Source(), msg.Age())
+	return true
+}
+
+type jsonAttachment struct {
+	Size int `json:"size"`
+}
+
+type jsonReceivedMessage struct {
+	Source       string           `json:"source"`
+	SourceDevice uint32           `json:"sourceDevice,omitempty"`
+	Message      string           `json:"message"`
+	Timestamp    uint64           `json:"timestamp"`
+	Group        string           `json:"group,omitempty"`
+	Attachments  []jsonAttachment `json:"attachments,omitempty"`
+}
+
+// MarshalJSON encodes the message for logging or forwarding.
+// Attachments are described by their size only, their contents
+// are available from Attachments.
+func (m Message) MarshalJSON() ([]byte, error) {
+	jm := jsonReceivedMessage{
+		Source:       m.source,
+		SourceDevice: m.sourceDevice,
+		Message:      m.message,
+		Timestamp:    m.timestamp,
+		Group:        m.group,
+	}
+	for _, a := range m.attachments {
+		jm.Attachments = append(jm.Attachments, jsonAttachment{Size: len(a)})
+	}
+	return json.Marshal(jm)
+}
+
 // Client contains application specific data and callbacks.
 type Client struct {
-	RootDir             string
+	RootDir string
+	// GetVerificationCode is called during registration to obtain the code
+	// sent by the server, so it can come from a terminal, a GUI or an SMS gateway.
 	GetVerificationCode func() string
 	GetStoragePassword  func() string
 	GetConfig           func() (*Config, error)
 	GetLocalContacts    func() ([]Contact, error)
 	MessageHandler      func(*Message)
+	// ReadLine is a generic prompt used when a more specific callback is unset.
+	// The library never reads from a terminal itself: if a needed callback and
+	// ReadLine are both unset, Setup fails with ErrNoVerificationCode or ErrNoStoragePassword.
+	ReadLine func(prompt string) string
+	// OutgoingHook and OutgoingCiphertextHook observe every outgoing message
+	// just before and just after encryption, for debugging delivery problems.
+	OutgoingHook           func(recipient string, deviceID uint32, plaintext []byte)
+	OutgoingCiphertextHook func(recipient string, deviceID uint32, ciphertext []byte)
+	// Metrics, if set, is notified of sent and received messages, failures and latencies.
+	Metrics Metrics
+	// ReceiptHandler is called when a delivery receipt arrives, with the recipient
+	// and the timestamp of the message that was delivered.
+	ReceiptHandler func(source string, timestamp uint64)
+	// Middleware is run in order on every received message before MessageHandler,
+	// for logging, access control or command parsing. Returning false drops the message.
+	Middleware []func(*Message) bool
+	// UnknownEnvelopeHandler is called with envelopes of types this library does not know,
+	// so applications can handle types added to the server later.
+	UnknownEnvelopeHandler func(typ int32, source string, content []byte)
+	// DeferRegistration makes Setup return without registering an unregistered number,
+	// so the application can call RegisterDevice when and how it chooses.
+	DeferRegistration bool
+	// QueueEmptyHandler is called when the server has delivered all the messages
+	// queued while we were offline, so the application knows it is caught up.
+	QueueEmptyHandler func()
+	// DecryptionErrorHandler is called when a message from a peer device cannot be decrypted,
+	// with sessionReset set when the failure made us archive the session with that device.
+	DecryptionErrorHandler func(source string, deviceID uint32, err error, sessionReset bool)
+	// Clock, if set, replaces the system clock for timers and timestamps, for tests.
+	Clock Clock
+	// GetRegistrationLockPIN is called when registering a number protected by a
+	// registration lock, with the time left before the lock expires.
+	// Returning an empty string gives up and Setup fails with ErrRegistrationLocked.
+	GetRegistrationLockPIN func(timeRemaining time.Duration) string
+	// TrustDecision is called synchronously, while sending or receiving, with an identity key
+	// seen for the first time or different from the trusted one, to apply the application's
+	// own trust policy. If unset, first keys are trusted and changed keys rejected.
+	TrustDecision func(tel string, identityKey []byte, firstUse bool) Trust
+	// VerificationCodeProvider, if set, is used instead of GetVerificationCode,
+	// for registering numbers whose codes do not arrive on a phone.
+	VerificationCodeProvider VerificationCodeProvider
+	// StoragePasswordProvider, if set, is used instead of GetStoragePassword.
+	// An error from it, as when the password source is unavailable, fails Setup.
+	// EnvPassword, FilePassword and KeyringPassword return ready-made providers.
+	StoragePasswordProvider func() (string, error)
 }
 
 var (
@@ -174,40 +481,80 @@ var (
 )
 
 // Setup initializes the package.
+// If the number is not registered yet, it registers it using the configured
+// verification type, unless Client.DeferRegistration is set, in which case
+// the application must call RegisterDevice itself.
 func Setup(c *Client) error {
 	var err error
 
+	// the rotator of a previous Setup must not run against the new client and store
+	stopSignedPreKeyRotation()
 	client = c
 
-	config, err = loadConfig()
+	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
+	setConfig(cfg)
+	resetDirectoryCache()
 
-	setupStore()
+	err = setupStore()
+	if err != nil {
+		return err
+	}
 
 	if needsRegistration() {
-		registrationInfo.registrationID = generateRegistrationID()
-		textSecureStore.SetLocalRegistrationID(registrationInfo.registrationID)
+		if client.DeferRegistration {
+			return nil
+		}
+		return RegisterDevice(conf().VerificationType)
+	}
+	return loadRegistration()
+}
 
-		registrationInfo.password = generatePassword()
-		textSecureStore.storeHTTPPassword(registrationInfo.password)
+// RegisterDevice registers the configured number with the server, having the
+// verification code sent by the given method, "sms" or "voice".
+// An empty method uses the configured verification type.
+// It is called by Setup unless Client.DeferRegistration is set.
+func RegisterDevice(method string) error {
+	if textSecureStore == nil {
+		return errors.New("Setup must be called before RegisterDevice")
+	}
+	if textSecureStore.loadRegisteredTel() == conf().Tel && !conf().ForceRegistration {
+		return ErrRegisteredLocally
+	}
 
-		registrationInfo.signalingKey = generateSignalingKey()
-		textSecureStore.storeHTTPSignalingKey(registrationInfo.signalingKey)
+	registrationInfo.registrationID = generateRegistrationID()
+	identityKey = axolotl.GenerateIdentityKeyPair()
+	if restoredIdentity != nil {
+		registrationInfo.registrationID = restoredIdentity.registrationID
+		identityKey = restoredIdentity.keyPair
+	}
+	textSecureStore.SetLocalRegistrationID(registrationInfo.registrationID)
 
-		identityKey = axolotl.GenerateIdentityKeyPair()
-		err := textSecureStore.SetIdentityKeyPair(identityKey)
-		if err != nil {
-			return err
-		}
+	registrationInfo.password = generatePassword()
+	textSecureStore.storeHTTPPassword(registrationInfo.password)
 
-		setupTransporter()
-		err = registerDevice()
-		if err != nil {
-			return err
-		}
+	registrationInfo.signalingKey = generateSignalingKey()
+	textSecureStore.storeHTTPSignalingKey(registrationInfo.signalingKey)
+
+	err := textSecureStore.SetIdentityKeyPair(identityKey)
+	if err != nil {
+		return err
 	}
+
+	setupTransporter()
+	err = registerDevice(method)
+	if err != nil {
+		return err
+	}
+	return loadRegistration()
+}
+
+// loadRegistration loads the registration state from the store
+// and prepares the connection to the server.
+func loadRegistration() error {
+	var err error
 	registrationInfo.registrationID, err = textSecureStore.GetLocalRegistrationID()
 	if err != nil {
 		return err
@@ -220,28 +567,51 @@ func Setup(c *Client) error {
 	if err != nil {
 		return err
 	}
+	registrationInfo.uuid = textSecureStore.loadUUID()
+	if tel := textSecureStore.loadRegisteredTel(); tel != "" && tel != conf().Tel && !conf().ForceRegistration {
+		// after ChangeNumber, until the application updates the config file
+		log.Printf("The store is registered with %s but the config has tel %s, using %s\n", tel, conf().Tel, tel)
+		cfg := *conf()
+		cfg.Tel = tel
+		setConfig(&cfg)
+	}
 	setupTransporter()
 	identityKey, err = textSecureStore.GetIdentityKeyPair()
-	return err
+	if err != nil {
+		return err
+	}
+	startSignedPreKeyRotation()
+	return nil
 }
 
-func registerDevice() error {
-	vt := config.VerificationType
+func registerDevice(vt string) error {
+	if vt == "" {
+		vt = conf().VerificationType
+	}
 	if vt == "" {
 		vt = "sms"
 	}
-	code, err := requestCode(config.Tel, vt)
+	code, err := requestCode(conf().Tel, vt)
 	if err != nil {
 		return err
 	}
 	if code == "" {
-		code = client.GetVerificationCode()
+		code, err = getVerificationCode()
+		if err != nil {
+			return err
+		}
 	}
 	code = strings.Replace(code, "-", "", -1)
-	err = verifyCode(code)
+	uuid, err := verifyCode(currentTransport(), code, "")
+	if lerr, ok := err.(RegistrationLockedError); ok && client.GetRegistrationLockPIN != nil {
+		if pin := client.GetRegistrationLockPIN(lerr.TimeRemaining); pin != "" {
+			uuid, err = verifyCode(currentTransport(), code, pin)
+		}
+	}
 	if err != nil {
 		return err
 	}
+	textSecureStore.storeUUID(uuid)
 	err = generatePreKeys()
 	if err != nil {
 		return err
@@ -250,16 +620,54 @@ func registerDevice() error {
 	if err != nil {
 		return err
 	}
-	err = registerPreKeys2()
+	err = registerPreKeys2(currentTransport())
 	if err != nil {
 		return err
 	}
+	textSecureStore.storeRegisteredTel(conf().Tel)
 	log.Println("Registration done")
 	return nil
 }
 
+// ErrRegisteredLocally is returned by Setup and RegisterDevice when the store shows
+// that the number was already registered from this installation.
+// The check is local only: the server accepts a new registration of a number
+// without telling that it was registered elsewhere, so a number registered from
+// another installation is not detected. Registering again replaces the existing
+// registration on the server and invalidates the previously registered device,
+// so it must be requested with Config.ForceRegistration.
+var ErrRegisteredLocally = errors.New("Number already registered from this installation, set forceRegistration to register it again")
+
+// ErrNoVerificationCode is returned when registration needs a verification
+// code but the client provided no way to obtain it.
+var ErrNoVerificationCode = errors.New("No verification code callback set")
+
+// VerificationCodeProvider obtains the verification code sent to a number
+// being registered without interactive input, for instance by polling the API
+// of the SMS gateway the numbers of a fleet are provisioned through.
+type VerificationCodeProvider interface {
+	// VerificationCode waits for the code sent to the given number and returns it.
+	VerificationCode(tel string) (string, error)
+}
+
+// getVerificationCode obtains the code received via SMS or voice from the
+// client's VerificationCodeProvider or, if none is set, by asking the client,
+// falling back to ReadLine if no dedicated callback is set.
+func getVerificationCode() (string, error) {
+	if client.VerificationCodeProvider != nil {
+		return client.VerificationCodeProvider.VerificationCode(conf().Tel)
+	}
+	if client.GetVerificationCode != nil {
+		return client.GetVerificationCode(), nil
+	}
+	if client.ReadLine != nil {
+		return client.ReadLine("Enter verification code>"), nil
+	}
+	return "", ErrNoVerificationCode
+}
+
 func ShowFingerprint(id string) {
-	if id == "me" || id == "self" || id == config.Tel {
+	if id == "me" || id == "self" || id == conf().Tel {
 		key, err := textSecureStore.GetIdentityKeyPair()
 		if err != nil {
 			log.Println(err)
@@ -267,52 +675,93 @@ func ShowFingerprint(id string) {
 			log.Printf("Fingerprint for %s is % 0X", id, key.PublicKey.ECPublicKey.Key())
 		}
 	} else {
-		key := textSecureStore.GetUserIdentityKeyPair(recID(id))
-		log.Printf("Fingerprint for %s is % 0X", id, key.PublicKey.ECPublicKey.Key())
+		recid, err := recID(id)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		key, err := textSecureStore.loadRemoteIdentity(recid)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		log.Printf("Fingerprint for %s is % 0X", id, key.Key())
 	}
 }
 
-func handleReceipt(ipms *textsecure.IncomingPushMessageSignal) {
-	//log.Printf("Receipt %+v\n", ipms)
-}
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
 
-func recID(source string) string {
-	return source[1:]
+// recID returns the identifier used to name the sessions and identities of a peer
+// in the store, which is the phone number without the leading + or a UUID as is.
+func recID(source string) (string, error) {
+	if len(source) > 1 && source[0] == '+' {
+		return source[1:], nil
+	}
+	if uuidRegexp.MatchString(source) {
+		return strings.ToLower(source), nil
+	}
+	return "", fmt.Errorf("Invalid source identifier %q", source)
 }
 
-// handleMessageBody unmarshals the message and calls the client callbacks
-func handleMessageBody(src string, b []byte) error {
+// parseMessageBody unmarshals the decrypted message content into a Message.
+func parseMessageBody(src string, b []byte) (*Message, error) {
 	b = stripPadding(b)
 	pmc := &textsecure.PushMessageContent{}
 	err := proto.Unmarshal(b, pmc)
 	if err != nil {
-		return err
-	}
-	atts, err := handleAttachments(pmc)
-	if err != nil {
-		return err
+		return nil, err
 	}
+	atts, skipped := handleAttachments(pmc)
 
 	gr, err := handleGroups(src, pmc)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	msg := &Message{
+		typ:         messageType(pmc),
 		source:      src,
 		message:     pmc.GetBody(),
 		attachments: atts,
+		pointers:    attachmentPointers(pmc),
+		skipped:     skipped,
 		group:       gr,
 	}
+	return msg, nil
+}
 
-	if client.MessageHandler != nil {
-		client.MessageHandler(msg)
+// messageType infers the kind of a message from its content.
+func messageType(pmc *textsecure.PushMessageContent) MessageType {
+	if pmc.GetFlags()&uint32(textsecure.PushMessageContent_END_SESSION) != 0 {
+		return EndSessionMessage
 	}
-	return nil
+	if pmc.GetSync() != nil {
+		return SyncMessage
+	}
+	switch pmc.GetGroup().GetType() {
+	case textsecure.PushMessageContent_GroupContext_UPDATE:
+		return GroupUpdateMessage
+	case textsecure.PushMessageContent_GroupContext_QUIT:
+		return GroupQuitMessage
+	}
+	return TextMessage
 }
 
 // Authenticate and decrypt a received message
-func handleReceivedMessage(msg []byte) error {
+// If config.RecoverFromPanics is set, a panic while handling the message is logged
+// and returned as an error instead of crashing the program.
+func handleReceivedMessage(msg []byte) (err error) {
+	if conf().RecoverFromPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Panic while handling a received message: %v\n%s", r, debug.Stack())
+				err = fmt.Errorf("Panic while handling a received message: %v", r)
+			}
+		}()
+	}
+	if len(msg) < 11 {
+		return errors.New("Incoming message too short")
+	}
 	macpos := len(msg) - 10
 	tmac := msg[macpos:]
 	aesKey := registrationInfo.signalingKey[:32]
@@ -331,49 +780,199 @@ func handleReceivedMessage(msg []byte) error {
 	if err != nil {
 		return err
 	}
+	return handleEnvelope(ipms)
+}
+
+// ReceiveMessages fetches the messages queued on the server over HTTP,
+// decrypts them and removes them from the queue.
+// Messages which cannot be decrypted are removed too, as fetching them again
+// would not help, and are listed by DecryptionFailures.
+// It is an alternative to ListenForMessages for when websockets are not available.
+func ReceiveMessages() ([]Message, error) {
+	qms, err := fetchMessages()
+	if err != nil {
+		return nil, err
+	}
+	msgs := []Message{}
+	for _, qm := range qms {
+		msg, err := decryptEnvelope(qm.envelope())
+		if err != nil {
+			// already recorded in the decryption failure log
+			log.Println(err)
+		}
+		err = AckMessage(qm.Source, qm.Timestamp)
+		if err != nil {
+			log.Println(err)
+		}
+		if msg != nil {
+			msgs = append(msgs, *msg)
+		}
+	}
+	return msgs, nil
+}
+
+// PendingMessageCount returns the number of messages waiting in the server queue,
+// without decrypting them or removing them from the queue.
+// It lets a client woken up by a push notification decide whether to connect.
+func PendingMessageCount() (int, error) {
+	qms, err := fetchMessages()
+	if err != nil {
+		return 0, err
+	}
+	return len(qms), nil
+}
+
+// Poll fetches the messages queued on the server over HTTP
+// and passes them to the MessageHandler.
+// It can be used instead of ListenForMessages to receive on demand.
+func Poll() error {
+	msgs, err := ReceiveMessages()
+	if err != nil {
+		return err
+	}
+	if client.MessageHandler != nil {
+		for i := range msgs {
+			dispatchMessage(&msgs[i])
+		}
+	}
+	return nil
+}
+
+// dispatchMessage runs a received message through the client middleware
+// and passes it to the MessageHandler unless it was dropped.
+func dispatchMessage(msg *Message) {
+	if tooOld(msg) {
+		return
+	}
+	for _, mw := range client.Middleware {
+		if !mw(msg) {
+			return
+		}
+	}
+	if err := markUnread(msg); err != nil {
+		log.Println(err)
+	}
+	client.MessageHandler(msg)
+}
+
+// handleEnvelope decrypts a message envelope and calls the client callbacks
+func handleEnvelope(ipms *textsecure.IncomingPushMessageSignal) error {
+	msg, err := decryptEnvelope(ipms)
+	if err != nil {
+		return err
+	}
+	if msg != nil && client.MessageHandler != nil {
+		dispatchMessage(msg)
+	}
+	return nil
+}
+
+// decryptEnvelope decrypts a message envelope, returning nil for envelopes
+// which carry no message for the client, such as receipts.
+func decryptEnvelope(ipms *textsecure.IncomingPushMessageSignal) (*Message, error) {
+	metrics().IncCounter(MetricMessagesReceived)
+	msg, err := decryptEnvelopeContent(ipms)
+	trackDecryption(ipms, err)
+	if err != nil {
+		metrics().IncCounter(MetricDecryptionFailures)
+		return nil, err
+	}
+	if msg != nil {
+		msg.timestamp = ipms.GetTimestamp()
+		msg.sourceDevice = ipms.GetSourceDevice()
+		if msg.typ == EndSessionMessage {
+			endSession(msg.source)
+		}
+	}
+	return msg, nil
+}
+
+// HasSession reports whether a secure session with the contact exists.
+// If not, the first message sent to it fetches its prekeys and may fail
+// with a NotTrustedError if its identity key changed.
+func HasSession(tel string) (bool, error) {
+	tel, err := normalizeRecipient(tel)
+	if err != nil {
+		return false, err
+	}
+	recid, err := recID(tel)
+	if err != nil {
+		return false, err
+	}
+	return len(textSecureStore.GetSubDeviceSessions(recid)) > 0, nil
+}
+
+// ErrNoSession is returned when a message arrives from a device we have no session with,
+// for example after the local store was lost. The peer needs to establish a new session
+// by sending a prekey message, which happens after it resets the session with us.
+var ErrNoSession = errors.New("No session with the sender, the peer needs to reset the session")
+
+func decryptEnvelopeContent(ipms *textsecure.IncomingPushMessageSignal) (*Message, error) {
 	//log.Printf("%s %s %d\n", ipms.GetType(), ipms.GetSource(), ipms.GetSourceDevice())
-	recid := recID(ipms.GetSource())
-	sc := axolotl.NewSessionCipher(textSecureStore, textSecureStore, textSecureStore, textSecureStore, recid, ipms.GetSourceDevice())
-	switch *ipms.Type {
+	recid, err := recID(ipms.GetSource())
+	if err != nil {
+		return nil, err
+	}
+	sc := sessionCipher(recid, ipms.GetSourceDevice())
+	switch ipms.GetType() {
 	case textsecure.IncomingPushMessageSignal_RECEIPT:
 		handleReceipt(ipms)
-		return nil
+		return nil, nil
 	case textsecure.IncomingPushMessageSignal_CIPHERTEXT:
+		key := newEnvelopeKey(ipms, 0)
+		if receivedEnvelopes.contains(key) {
+			log.Printf("Dropping duplicate message from %s\n", ipms.GetSource())
+			return nil, nil
+		}
+		if !textSecureStore.ContainsSession(recid, ipms.GetSourceDevice()) {
+			log.Printf("No session with device %d of %s\n", ipms.GetSourceDevice(), ipms.GetSource())
+			return nil, ErrNoSession
+		}
 		wm, err := axolotl.LoadWhisperMessage(ipms.GetMessage())
 		if err != nil {
-			return err
+			return nil, err
 		}
 		b, err := sc.SessionDecryptWhisperMessage(wm)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		err = handleMessageBody(ipms.GetSource(), b)
-		if err != nil {
-			return err
-		}
-
+		receivedEnvelopes.add(key)
+		return parseMessageBody(ipms.GetSource(), b)
 	case textsecure.IncomingPushMessageSignal_PLAINTEXT:
 		pmc := &textsecure.PushMessageContent{}
-		err = proto.Unmarshal(ipms.GetMessage(), pmc)
+		err := proto.Unmarshal(ipms.GetMessage(), pmc)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		return nil, nil
 	case textsecure.IncomingPushMessageSignal_PREKEY_BUNDLE:
 		pkwm, err := axolotl.LoadPreKeyWhisperMessage(ipms.GetMessage())
 		if err != nil {
-			return err
+			return nil, err
+		}
+		// A redelivered prekey message would replace the session it created
+		key := newEnvelopeKey(ipms, pkwm.PreKeyID)
+		if receivedEnvelopes.contains(key) {
+			log.Printf("Dropping duplicate prekey message from %s\n", ipms.GetSource())
+			return nil, nil
 		}
 		b, err := sc.SessionDecryptPreKeyWhisperMessage(pkwm)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		err = handleMessageBody(ipms.GetSource(), b)
-		if err != nil {
-			return err
+		receivedEnvelopes.add(key)
+		if pkwm.PreKeyID != lastResortPreKeyID {
+			go replenishPreKeys()
 		}
+		return parseMessageBody(ipms.GetSource(), b)
 	default:
-		return fmt.Errorf("Not implemented %d", *ipms.Type)
+		if client.UnknownEnvelopeHandler != nil {
+			client.UnknownEnvelopeHandler(int32(ipms.GetType()), ipms.GetSource(), ipms.GetMessage())
+		}
+		if conf().IgnoreUnknownEnvelopes {
+			// acknowledged so the server does not deliver it again
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Not implemented %d", ipms.GetType())
 	}
-
-	return nil
 }
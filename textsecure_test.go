@@ -0,0 +1,358 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zmanian/textsecure/axolotl"
+	"github.com/zmanian/textsecure/curve25519sign"
+	"github.com/zmanian/textsecure/internal/testutil"
+	"github.com/zmanian/textsecure/protobuf"
+)
+
+func envelope(typ textsecure.IncomingPushMessageSignal_Type, source string, device uint32) *textsecure.IncomingPushMessageSignal {
+	return &textsecure.IncomingPushMessageSignal{
+		Type:         &typ,
+		Source:       &source,
+		SourceDevice: &device,
+		Message:      []byte{0x33},
+	}
+}
+
+func TestVerifySignedPreKey(t *testing.T) {
+	ikp := axolotl.GenerateIdentityKeyPair()
+	spk := axolotl.NewECKeyPair()
+	var random [64]byte
+	sig := curve25519sign.Sign(ikp.PrivateKey.Key(), spk.PublicKey.Serialize(), random)
+
+	ik := ikp.PublicKey.Key()[:]
+	assert.NoError(t, verifySignedPreKey(ik, spk.PublicKey.Key()[:], sig[:]))
+
+	other := axolotl.NewECKeyPair()
+	assert.Equal(t, ErrInvalidSignedPreKey, verifySignedPreKey(ik, other.PublicKey.Key()[:], sig[:]))
+}
+
+func TestMessageMarshalJSON(t *testing.T) {
+	m := Message{
+		source:       "+14155550100",
+		sourceDevice: 2,
+		message:      "hello",
+		timestamp:    1420070400000,
+		attachments:  [][]byte{make([]byte, 5)},
+	}
+	b, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"source":"+14155550100","sourceDevice":2,"message":"hello","timestamp":1420070400000,"attachments":[{"size":5}]}`, string(b))
+}
+
+func TestMessageIsFromSelf(t *testing.T) {
+	config = &Config{Tel: "+14155550100"}
+	defer func() { config = nil }()
+
+	assert.True(t, (&Message{source: "+14155550100"}).IsFromSelf())
+	assert.True(t, (&Message{source: "+14155550101", typ: SyncMessage}).IsFromSelf())
+	assert.False(t, (&Message{source: "+14155550101"}).IsFromSelf())
+}
+
+func TestIsNoteToSelf(t *testing.T) {
+	config = &Config{Tel: "+14155550100"}
+	defer func() { config = nil }()
+
+	assert.True(t, isNoteToSelf(&outgoingMessage{tel: "+14155550100"}))
+	assert.True(t, isNoteToSelf(&outgoingMessage{tel: "+1 415 555 0100"}))
+	assert.False(t, isNoteToSelf(&outgoingMessage{tel: "+14155550101"}))
+	assert.False(t, isNoteToSelf(&outgoingMessage{
+		tel:  "+14155550100",
+		sync: &syncContext{"+14155550101", 1},
+	}), "transcripts go to our own number")
+}
+
+func TestTooOld(t *testing.T) {
+	clk := testutil.NewClock(time.Unix(1420070400, 0))
+	config, client = &Config{MaxMessageAge: 60}, &Client{Clock: clk}
+	defer func() { config, client = nil, nil }()
+
+	msg := &Message{timestamp: makeTimestamp()}
+	clk.Advance(time.Minute)
+	assert.Equal(t, time.Minute, msg.Age())
+	assert.False(t, tooOld(msg))
+	clk.Advance(time.Second)
+	assert.True(t, tooOld(msg))
+}
+
+func TestNeedsSync(t *testing.T) {
+	body := func(s string) *response {
+		return &response{Status: 200, Body: ioutil.NopCloser(strings.NewReader(s))}
+	}
+	assert.True(t, needsSync(body(`{"needsSync":true}`)))
+	assert.False(t, needsSync(body(`{"needsSync":false}`)))
+	assert.False(t, needsSync(body(``)))
+	assert.False(t, needsSync(&response{Status: 204}))
+}
+
+func TestParseVerifyResponse(t *testing.T) {
+	body := func(s string) *response {
+		return &response{Status: 200, Body: ioutil.NopCloser(strings.NewReader(s))}
+	}
+	assert.Equal(t, "0d5b8a5e-6a3b-4c7e-9f1a-2b3c4d5e6f70",
+		parseVerifyResponse(body(`{"uuid":"0D5B8A5E-6A3B-4C7E-9F1A-2B3C4D5E6F70","storageCapable":false}`)))
+	assert.Equal(t, "", parseVerifyResponse(body(`{"uuid":"not-a-uuid"}`)))
+	assert.Equal(t, "", parseVerifyResponse(body(``)))
+	assert.Equal(t, "", parseVerifyResponse(&response{Status: 204}))
+}
+
+// gatewayCodes stands in for an SMS gateway holding the codes sent to our numbers.
+type gatewayCodes map[string]string
+
+func (g gatewayCodes) VerificationCode(tel string) (string, error) {
+	if code, ok := g[tel]; ok {
+		return code, nil
+	}
+	return "", errors.New("no code received")
+}
+
+func TestSetDiscoverableByPhoneNumber(t *testing.T) {
+	config, transport = &Config{}, okTransport{}
+	defer func() { config, transport = nil, nil }()
+
+	// the setting is read concurrently while it changes
+	stop, done := make(chan bool), make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				DiscoverableByPhoneNumber()
+			}
+		}
+	}()
+	assert.NoError(t, SetDiscoverableByPhoneNumber(false))
+	assert.False(t, DiscoverableByPhoneNumber())
+	assert.NoError(t, SetDiscoverableByPhoneNumber(true))
+	assert.True(t, DiscoverableByPhoneNumber())
+	close(stop)
+	<-done
+
+	setConfig(&Config{})
+	transport = downTransport{}
+	assert.Error(t, SetDiscoverableByPhoneNumber(false))
+	assert.True(t, DiscoverableByPhoneNumber(), "unchanged when the server was not updated")
+}
+
+func TestGetVerificationCode(t *testing.T) {
+	config, client = &Config{Tel: "+14155550100"}, &Client{}
+	defer func() { config, client = nil, nil }()
+
+	_, err := getVerificationCode()
+	assert.Equal(t, ErrNoVerificationCode, err)
+
+	client.GetVerificationCode = func() string { return "111-111" }
+	code, err := getVerificationCode()
+	assert.NoError(t, err)
+	assert.Equal(t, "111-111", code)
+
+	client.VerificationCodeProvider = gatewayCodes{"+14155550100": "123-456"}
+	code, err = getVerificationCode()
+	assert.NoError(t, err)
+	assert.Equal(t, "123-456", code)
+
+	config.Tel = "+14155550101"
+	_, err = getVerificationCode()
+	assert.Error(t, err)
+}
+
+// queueTransport serves a message queue over HTTP, delivering each message
+// until it is acknowledged.
+type queueTransport struct {
+	messages []jsonQueuedMessage
+	fetches  int
+}
+
+func (qt *queueTransport) get(url string) (*response, error) {
+	if url != endpoints().Messages {
+		return &response{Status: 404}, nil
+	}
+	qt.fetches++
+	b, err := json.Marshal(map[string][]jsonQueuedMessage{"messages": qt.messages})
+	if err != nil {
+		return nil, err
+	}
+	return &response{Status: 200, Body: ioutil.NopCloser(bytes.NewReader(b))}, nil
+}
+
+func (qt *queueTransport) putJSON(url string, body []byte) (*response, error) {
+	return &response{Status: 200}, nil
+}
+
+func (qt *queueTransport) putBinary(url string, body []byte) (*response, error) {
+	return &response{Status: 200}, nil
+}
+
+func (qt *queueTransport) del(url string) (*response, error) {
+	for i, m := range qt.messages {
+		if url == fmt.Sprintf(endpoints().DeleteMessage, m.Source, m.Timestamp) {
+			qt.messages = append(qt.messages[:i], qt.messages[i+1:]...)
+			return &response{Status: 204}, nil
+		}
+	}
+	return &response{Status: 404}, nil
+}
+
+func TestReceiveUndecryptableMessage(t *testing.T) {
+	defer setupTestStore(t)()
+	defer func() { failureLog.path, failureLog.failures = "", nil }()
+	assert.NoError(t, setupFailureLog())
+	qt := &queueTransport{messages: []jsonQueuedMessage{{
+		Type:         int32(textsecure.IncomingPushMessageSignal_CIPHERTEXT),
+		Source:       "+14155550160",
+		SourceDevice: 1,
+		Timestamp:    1000,
+		Message:      []byte{0x33},
+	}}}
+	transport = qt
+
+	for i := 0; i < 2; i++ {
+		msgs, err := ReceiveMessages()
+		assert.NoError(t, err)
+		assert.Empty(t, msgs)
+	}
+	assert.Equal(t, 2, qt.fetches)
+	assert.Empty(t, qt.messages, "the message is removed from the queue")
+	assert.Len(t, DecryptionFailures(), 1, "the failure is recorded once")
+}
+
+func TestSplitMessage(t *testing.T) {
+	assert.Equal(t, []string{"hello"}, splitMessage("hello", 10))
+	assert.Equal(t, []string{"hello", "world"}, splitMessage("hello world", 8))
+	assert.Equal(t, []string{"abcd", "efgh", "ij"}, splitMessage("abcdefghij", 4))
+	assert.Equal(t, []string{"a", "b"}, splitMessage("a"+strings.Repeat(" ", 10)+"b", 4), "no empty parts for long runs of whitespace")
+	assert.Equal(t, []string{"ab"}, splitMessage("ab"+strings.Repeat(" ", 10), 4))
+	for _, part := range splitMessage("ééééé", 3) {
+		assert.Equal(t, "é", part)
+	}
+}
+
+func TestDecryptEnvelopeWithoutSession(t *testing.T) {
+	defer setupTestStore(t)()
+
+	_, err := decryptEnvelope(envelope(textsecure.IncomingPushMessageSignal_CIPHERTEXT, "+14155550100", 1))
+	assert.Equal(t, ErrNoSession, err)
+}
+
+func TestRegisterDeviceRegisteredLocally(t *testing.T) {
+	defer setupTestStore(t)()
+	config = &Config{Tel: "+14155550100"}
+
+	textSecureStore.storeRegisteredTel("+14155550100")
+	assert.Equal(t, ErrRegisteredLocally, RegisterDevice("sms"))
+}
+
+func TestDispatchMessageMiddleware(t *testing.T) {
+	var calls []string
+	config = &Config{}
+	client = &Client{
+		Middleware: []func(*Message) bool{
+			func(m *Message) bool { calls = append(calls, "log"); return true },
+			func(m *Message) bool { calls = append(calls, "acl"); return m.Source() != "+14155550101" },
+		},
+		MessageHandler: func(m *Message) { calls = append(calls, "handler") },
+	}
+	defer func() { client, config = nil, nil }()
+
+	dispatchMessage(&Message{source: "+14155550100"})
+	assert.Equal(t, []string{"log", "acl", "handler"}, calls)
+
+	calls = nil
+	dispatchMessage(&Message{source: "+14155550101"})
+	assert.Equal(t, []string{"log", "acl"}, calls)
+}
+
+func TestHasSession(t *testing.T) {
+	defer setupTestStore(t)()
+
+	has, err := HasSession("+14155550100")
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	assert.NoError(t, textSecureStore.StoreSession("14155550100", 2, axolotl.NewSessionRecord()))
+	assert.NoError(t, textSecureStore.StoreSession("141555501001", 1, axolotl.NewSessionRecord()))
+	has, err = HasSession("+14155550100")
+	assert.NoError(t, err)
+	assert.True(t, has)
+	assert.Equal(t, []uint32{2}, textSecureStore.GetSubDeviceSessions("14155550100"))
+}
+
+// multiDeviceTransport hands out prekeys for any device of a peer and
+// answers the first send with 409, reporting device 2 as missing.
+type multiDeviceTransport struct {
+	okTransport
+	keys  *testutil.PreKeyState
+	sends []jsonMessage
+	calls int
+}
+
+func (mt *multiDeviceTransport) get(url string) (*response, error) {
+	dev, err := strconv.Atoi(url[strings.LastIndex(url, "/")+1:])
+	if err != nil {
+		return &response{Status: 404}, nil
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"identityKey": mt.keys.IdentityKey,
+		"devices": []map[string]interface{}{{
+			"deviceId":       dev,
+			"registrationId": 42,
+			"signedPreKey":   mt.keys.SignedPreKey,
+			"preKey":         mt.keys.PreKeys[0],
+		}},
+	})
+	return &response{Status: 200, Body: ioutil.NopCloser(bytes.NewReader(b))}, nil
+}
+
+func (mt *multiDeviceTransport) putJSON(url string, body []byte) (*response, error) {
+	mt.calls++
+	if mt.calls == 1 {
+		return &response{Status: 409, Body: ioutil.NopCloser(strings.NewReader(`{"missingDevices":[2]}`))}, nil
+	}
+	var m struct {
+		Messages []jsonMessage `json:"messages"`
+	}
+	json.Unmarshal(body, &m)
+	mt.sends = append(mt.sends, m.Messages...)
+	return &response{Status: 200}, nil
+}
+
+func TestMissingDevices(t *testing.T) {
+	defer setupTestStore(t)()
+	identityKey = axolotl.GenerateIdentityKeyPair()
+	assert.NoError(t, textSecureStore.SetIdentityKeyPair(identityKey))
+	textSecureStore.SetLocalRegistrationID(1)
+	mt := &multiDeviceTransport{keys: peerKeys()}
+	config, transport = &Config{Tel: "+14155550100"}, mt
+
+	assert.NoError(t, SendMessage("+14155550150", "hello"))
+	assert.Equal(t, 2, mt.calls, "the send is retried once the missing device has a session")
+	if assert.Len(t, mt.sends, 2) {
+		assert.Equal(t, uint32(1), mt.sends[0].DestDeviceID)
+		assert.Equal(t, uint32(2), mt.sends[1].DestDeviceID)
+	}
+
+	// a message for one device cannot satisfy the server
+	mt = &multiDeviceTransport{keys: peerKeys()}
+	transport = mt
+	assert.Equal(t, ErrSingleDeviceRejected, SendMessageToDevice("+14155550151", 1, "hello"))
+	assert.Equal(t, 1, mt.calls, "not retried")
+	assert.False(t, textSecureStore.ContainsSession("14155550151", 2), "no session started with the missing device")
+}
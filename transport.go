@@ -9,6 +9,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -18,37 +19,144 @@ import (
 
 type dialer func(network, addr string) (net.Conn, error)
 
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuiteID returns the ID of the cipher suite with the given name, as listed by crypto/tls.
+func cipherSuiteID(name string) (uint16, error) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown or insecure cipher suite %s", name)
+}
+
+// newTLSConfig returns the TLS settings used by both the HTTP and the websocket connections,
+// applying the minimum version and cipher suites from the configuration.
+func newTLSConfig(skipCAVerification bool) (*tls.Config, error) {
+	tc := &tls.Config{InsecureSkipVerify: skipCAVerification}
+	if conf() == nil {
+		return tc, nil
+	}
+	if conf().TLSMinVersion != "" {
+		v, ok := tlsVersions[conf().TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS version %s", conf().TLSMinVersion)
+		}
+		tc.MinVersion = v
+	}
+	for _, name := range conf().CipherSuites {
+		id, err := cipherSuiteID(name)
+		if err != nil {
+			return nil, err
+		}
+		tc.CipherSuites = append(tc.CipherSuites, id)
+	}
+	return tc, nil
+}
+
+// pinCandidates returns the certificates of the connection which may match the pinned key,
+// depending on the configured pin position:
+// "leaf" (the default) pins the server certificate itself, "ca" pins one of the CA
+// certificates of a verified chain, and "any" accepts either.
+// The CA certificates the server merely presented are never candidates, since anyone
+// can append a public CA certificate to their own leaf.
+func pinCandidates(cs tls.ConnectionState) ([]*x509.Certificate, error) {
+	pos := ""
+	if conf() != nil {
+		pos = conf().PinPosition
+	}
+	var leaf, cas []*x509.Certificate
+	if len(cs.PeerCertificates) > 0 {
+		leaf = cs.PeerCertificates[:1]
+	}
+	for _, chain := range cs.VerifiedChains {
+		if len(chain) > 1 {
+			cas = append(cas, chain[1:]...)
+		}
+	}
+	switch pos {
+	case "", "leaf":
+		return leaf, nil
+	case "ca":
+		return cas, nil
+	case "any":
+		return append(leaf, cas...), nil
+	}
+	return nil, fmt.Errorf("Unknown pin position %s", pos)
+}
+
+// ErrKeyPinFailed is returned when the server does not present the pinned public key.
+var ErrKeyPinFailed = errors.New("Key Pin Failed. Certificate Signed with an invalid Public Key")
+
+// newPinnedDialer returns the TLS dialer shared by the HTTP and websocket connections,
+// which checks the server's public key against the hex encoded SHA256 fingerprint.
+func newPinnedDialer(keyFingerprint string, skipCAVerification bool) (dialer, error) {
+	fingerprint, err := hex.DecodeString(keyFingerprint)
+	if err != nil {
+		return nil, err
+	}
+	return makeDialer(fingerprint, skipCAVerification), nil
+}
+
 func makeDialer(fingerprint []byte, skipCAVerification bool) dialer {
 
 	return func(network, addr string) (net.Conn, error) {
-		c, err := tls.Dial(network, addr, &tls.Config{InsecureSkipVerify: skipCAVerification})
+		tc, err := newTLSConfig(skipCAVerification)
+		if err != nil {
+			return nil, err
+		}
+		dial, err := netDialer()
+		if err != nil {
+			return nil, err
+		}
+		raw, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tc.ServerName, _, err = net.SplitHostPort(addr)
+		if err != nil {
+			raw.Close()
+			return nil, err
+		}
+		c := tls.Client(raw, tc)
+		err = c.Handshake()
 		if err != nil {
-			return c, err
+			raw.Close()
+			return nil, err
 		}
 		connstate := c.ConnectionState()
+		certs, err := pinCandidates(connstate)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
 
 		keyPinValid := false
 
-		for _, peercert := range connstate.PeerCertificates {
+		for _, peercert := range certs {
 			der, err := x509.MarshalPKIXPublicKey(peercert.PublicKey)
-			hash := sha256.Sum256(der)
-			// 	log.Println(peercert.Issuer)
-			// 	log.Printf("%#v", hash)
-
 			if err != nil {
-				log.Fatal(err)
+				c.Close()
+				return nil, err
 			}
+			hash := sha256.Sum256(der)
 
-			if bytes.Compare(hash[0:], fingerprint) == 0 {
-				// log.Println("Pinned Key found")
+			if bytes.Equal(hash[:], fingerprint) {
 				keyPinValid = true
 			} else {
 				log.Printf("Untrusted Key Fingerprint: %x", hash)
 			}
 		}
 
-		if keyPinValid == false {
-			log.Fatal("Key Pin Failed. Certificate Signed with an invalid Public Key")
+		if !keyPinValid {
+			c.Close()
+			return nil, ErrKeyPinFailed
 		}
 
 		return c, nil
@@ -57,8 +165,28 @@ func makeDialer(fingerprint []byte, skipCAVerification bool) dialer {
 
 var transport transporter
 
+// currentTransport returns the transporter for requests to the server.
+func currentTransport() transporter {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return transport
+}
+
+// setupTransporter replaces the transporter with one using the current configuration.
 func setupTransporter() {
-	transport = NewHTTPTransporter(config.Server, config.Tel, registrationInfo.password, config.SkipTLSCheck, config.Fingerprint)
+	t := newTransporter(conf())
+	configMu.Lock()
+	defer configMu.Unlock()
+	transport = t
+}
+
+// newTransporter returns a transporter for requests with the given configuration.
+func newTransporter(cfg *Config) transporter {
+	ht := NewHTTPTransporter(cfg.Server, cfg.Tel, registrationInfo.password, cfg.SkipTLSCheck, cfg.Fingerprint)
+	if len(cfg.AlternateHosts) > 0 {
+		return newFrontedTransporter(ht, cfg)
+	}
+	return ht
 }
 
 type response struct {
@@ -78,6 +206,7 @@ type transporter interface {
 	get(url string) (*response, error)
 	putJSON(url string, body []byte) (*response, error)
 	putBinary(url string, body []byte) (*response, error)
+	del(url string) (*response, error)
 }
 
 type httpTransporter struct {
@@ -85,24 +214,37 @@ type httpTransporter struct {
 	user    string
 	pass    string
 	client  *http.Client
+	host    string // Host header when reaching the server through a front
 }
 
 func NewHTTPTransporter(baseURL, user, pass string, skipTLSCheck bool, keyFingerprint string) *httpTransporter {
 	client := &http.Client{}
-	fingerprint, err := hex.DecodeString(keyFingerprint)
+	dial, err := newPinnedDialer(keyFingerprint, skipTLSCheck)
+	if err != nil {
+		log.Fatal(err)
+	}
+	netDial, err := netDialer()
 	if err != nil {
 		log.Fatal(err)
 	}
 	client.Transport = &http.Transport{
-		DialTLS: makeDialer(fingerprint, skipTLSCheck),
+		Dial:    netDial,
+		DialTLS: dial,
 	}
 
-	return &httpTransporter{baseURL, user, pass, client}
+	return &httpTransporter{baseURL: baseURL, user: user, pass: pass, client: client}
 }
 
-func (ht *httpTransporter) get(url string) (*response, error) {
-	req, err := http.NewRequest("GET", ht.baseURL+url, nil)
+// ErrServerUnavailable is returned when the server answers with 503 Service Unavailable,
+// typically during maintenance. Clients should back off before trying again.
+var ErrServerUnavailable = errors.New("Server unavailable, possibly down for maintenance")
+
+// do sends an authenticated request and wraps the HTTP response.
+func (ht *httpTransporter) do(req *http.Request, url string) (*response, error) {
 	req.SetBasicAuth(ht.user, ht.pass)
+	if ht.host != "" {
+		req.Host = ht.host
+	}
 	resp, err := ht.client.Do(req)
 	r := &response{}
 	if resp != nil {
@@ -111,29 +253,42 @@ func (ht *httpTransporter) get(url string) (*response, error) {
 	}
 
 	if r.isError() {
-		log.Printf("GET %s %d\n", url, r.Status)
+		log.Printf("%s %s %d\n", req.Method, url, r.Status)
+	}
+
+	if err == nil && r.Status == http.StatusServiceUnavailable {
+		// The body is usually an HTML maintenance page, useless to the callers
+		r.Body.Close()
+		return r, ErrServerUnavailable
 	}
 
 	return r, err
 }
 
-func (ht *httpTransporter) put(url string, body []byte, ct string) (*response, error) {
-	br := bytes.NewReader(body)
-	req, err := http.NewRequest("PUT", ht.baseURL+url, br)
-	req.Header.Add("Content-type", ct)
-	req.SetBasicAuth(ht.user, ht.pass)
-	resp, err := ht.client.Do(req)
-	r := &response{}
-	if resp != nil {
-		r.Status = resp.StatusCode
-		r.Body = resp.Body
+func (ht *httpTransporter) get(url string) (*response, error) {
+	req, err := http.NewRequest("GET", ht.baseURL+url, nil)
+	if err != nil {
+		return nil, err
 	}
+	return ht.do(req, url)
+}
 
-	if r.isError() {
-		log.Printf("PUT %s %d\n", url, r.Status)
+func (ht *httpTransporter) del(url string) (*response, error) {
+	req, err := http.NewRequest("DELETE", ht.baseURL+url, nil)
+	if err != nil {
+		return nil, err
 	}
+	return ht.do(req, url)
+}
 
-	return r, err
+func (ht *httpTransporter) put(url string, body []byte, ct string) (*response, error) {
+	br := bytes.NewReader(body)
+	req, err := http.NewRequest("PUT", ht.baseURL+url, br)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-type", ct)
+	return ht.do(req, url)
 }
 
 func (ht *httpTransporter) putJSON(url string, body []byte) (*response, error) {
@@ -0,0 +1,36 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinCandidates(t *testing.T) {
+	leaf, presentedCA, verifiedCA := &x509.Certificate{}, &x509.Certificate{}, &x509.Certificate{}
+	cs := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{leaf, presentedCA},
+		VerifiedChains:   [][]*x509.Certificate{{leaf, verifiedCA}},
+	}
+	config = &Config{}
+	defer func() { config = nil }()
+
+	certs, err := pinCandidates(cs)
+	assert.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{leaf}, certs, "the leaf is pinned by default")
+
+	config.PinPosition = "ca"
+	certs, err = pinCandidates(cs)
+	assert.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{verifiedCA}, certs, "only CAs of a verified chain are candidates")
+
+	cs.VerifiedChains = nil
+	certs, err = pinCandidates(cs)
+	assert.NoError(t, err)
+	assert.Empty(t, certs, "presented but unverified CAs are never candidates")
+}
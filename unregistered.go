@@ -0,0 +1,56 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRecipientNotRegistered is returned when sending to a number which is not
+// registered with the server, so the application can fall back to SMS or tell
+// the user the contact cannot be reached.
+var ErrRecipientNotRegistered = errors.New("Recipient is not registered")
+
+// unregisteredTTL is how long a number found not registered is remembered,
+// sparing the server a query for every send attempt.
+const unregisteredTTL = 10 * time.Minute
+
+// unregistered caches the numbers the server reported as not registered,
+// with the time they were reported.
+var unregistered = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// markUnregistered remembers that the number is not registered.
+func markUnregistered(tel string) {
+	unregistered.Lock()
+	defer unregistered.Unlock()
+	unregistered.m[tel] = clock().Now()
+}
+
+// clearUnregistered forgets that the number was found not registered,
+// after the server accepted a message or gave out prekeys for it.
+func clearUnregistered(tel string) {
+	unregistered.Lock()
+	defer unregistered.Unlock()
+	delete(unregistered.m, tel)
+}
+
+// knownUnregistered reports whether the number was recently found not registered.
+func knownUnregistered(tel string) bool {
+	unregistered.Lock()
+	defer unregistered.Unlock()
+	t, ok := unregistered.m[tel]
+	if !ok {
+		return false
+	}
+	if since(t) > unregisteredTTL {
+		delete(unregistered.m, tel)
+		return false
+	}
+	return true
+}
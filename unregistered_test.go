@@ -0,0 +1,52 @@
+// Copyright (c) 2014 Canonical Ltd.
+// Licensed under the GPLv3, see the COPYING file for details.
+
+package textsecure
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zmanian/textsecure/internal/testutil"
+)
+
+func TestUnregisteredCache(t *testing.T) {
+	clk := testutil.NewClock(time.Unix(1420070400, 0))
+	client = &Client{Clock: clk}
+	defer func() { client = nil }()
+
+	assert.False(t, knownUnregistered("+14155550100"))
+	markUnregistered("+14155550100")
+	assert.True(t, knownUnregistered("+14155550100"))
+	assert.False(t, knownUnregistered("+14155550101"))
+	clk.Advance(unregisteredTTL + time.Second)
+	assert.False(t, knownUnregistered("+14155550100"))
+}
+
+// notFoundTransport answers every request with 404 Not Found.
+type notFoundTransport struct {
+	okTransport
+}
+
+func (notFoundTransport) get(url string) (*response, error) {
+	return &response{Status: 404}, nil
+}
+
+func TestUnregisteredOnlyForDefaultDevice(t *testing.T) {
+	defer setupTestStore(t)()
+	config, transport = &Config{Tel: "+14155550100"}, notFoundTransport{}
+
+	err := SendMessageToDevice("+14155550110", 2, "hello")
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrRecipientNotRegistered, err)
+	assert.False(t, knownUnregistered("+14155550110"), "an unknown device does not block the number")
+	_, err = linkedDevices()
+	assert.Error(t, err)
+	assert.False(t, knownUnregistered("+14155550100"), "our own number is never blocked")
+
+	assert.Equal(t, ErrRecipientNotRegistered, SendMessage("+14155550110", "hello"))
+	assert.True(t, knownUnregistered("+14155550110"))
+	clearUnregistered("+14155550110")
+	assert.False(t, knownUnregistered("+14155550110"))
+}
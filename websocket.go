@@ -4,26 +4,31 @@
 package textsecure
 
 import (
-	"crypto/tls"
 	"encoding/base64"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/zmanian/textsecure/protobuf"
 	"golang.org/x/net/websocket"
+	"io"
 	"log"
+	"math/rand"
 	"net"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
 type wsConn struct {
-	conn *websocket.Conn
-	id   uint64
+	conn   *websocket.Conn
+	id     uint64
+	closed chan struct{} // closed by close, stopping keepAlive
+	done   chan struct{} // closed when keepAlive exits
 }
 
-func dialWithPin(config *websocket.Config, fingerprint []byte) (ws *websocket.Conn, err error) {
+// dialWithPin opens a websocket connection, to addr if set instead of the host of its URL.
+func dialWithPin(config *websocket.Config, dial dialer, addr string) (ws *websocket.Conn, err error) {
 
 	var client net.Conn
 	if config.Location == nil {
@@ -32,12 +37,19 @@ func dialWithPin(config *websocket.Config, fingerprint []byte) (ws *websocket.Co
 	if config.Origin == nil {
 		return nil, &websocket.DialError{config, websocket.ErrBadWebSocketOrigin}
 	}
+	if addr == "" {
+		addr = config.Location.Host
+	}
 	switch config.Location.Scheme {
 	case "ws":
-		client, err = net.Dial("tcp", config.Location.Host)
+		var netDial dialer
+		netDial, err = netDialer()
+		if err == nil {
+			client, err = netDial("tcp", addr)
+		}
 
 	case "wss":
-		client, err = makeDialer(fingerprint, config.TlsConfig.InsecureSkipVerify)("tcp", config.Location.Host)
+		client, err = dial("tcp", addr)
 
 	default:
 		err = websocket.ErrBadScheme
@@ -56,7 +68,8 @@ Error:
 	return nil, &websocket.DialError{config, err}
 }
 
-func newWSConn(originURL, user, pass string, skipTLSCheck bool, fingerprint string) (*wsConn, error) {
+// newWSConn connects to the websocket at originURL, dialing addr instead of its host if set.
+func newWSConn(originURL, addr, user, pass string, skipTLSCheck bool, fingerprint string) (*wsConn, error) {
 	v := url.Values{}
 	v.Set("login", user)
 	v.Set("password", pass)
@@ -67,25 +80,47 @@ func newWSConn(originURL, user, pass string, skipTLSCheck bool, fingerprint stri
 	if err != nil {
 		return nil, err
 	}
-	if config.SkipTLSCheck {
-		wsConfig.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+	dial, err := newPinnedDialer(fingerprint, skipTLSCheck)
+	if err != nil {
+		return nil, err
 	}
-	pin, err := hex.DecodeString(fingerprint)
+	wsc, err := dialWithPin(wsConfig, dial, addr)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	wsc, err := dialWithPin(wsConfig, pin)
+	return &wsConn{conn: wsc, closed: make(chan struct{}), done: make(chan struct{})}, nil
+}
 
-	// 	wsc, err := websocket.DialConfig(wsConfig)
+// close closes the connection and waits for its keepAlive to exit.
+func (wsc *wsConn) close() {
+	activeWS.Lock()
+	if activeWS.wsc == wsc {
+		activeWS.wsc = nil
+	}
+	activeWS.Unlock()
+	close(wsc.closed)
+	wsc.conn.Close()
+	<-wsc.done
+}
 
-	if err != nil {
-		return nil, err
+// activeWS is the connection ListenForMessages is listening on, if any.
+var activeWS struct {
+	sync.Mutex
+	wsc *wsConn
+}
+
+// reconnectWebsocket drops the connection ListenForMessages is listening on,
+// so that it reconnects with the current settings and credentials.
+func reconnectWebsocket() {
+	activeWS.Lock()
+	defer activeWS.Unlock()
+	if activeWS.wsc != nil {
+		activeWS.wsc.conn.Close()
 	}
-	return &wsConn{conn: wsc}, nil
 }
 
-func (wsc *wsConn) send(b []byte) {
-	websocket.Message.Send(wsc.conn, b)
+func (wsc *wsConn) send(b []byte) error {
+	return websocket.Message.Send(wsc.conn, b)
 }
 
 func (wsc *wsConn) receive() ([]byte, error) {
@@ -115,17 +150,27 @@ func (wsc *wsConn) sendRequest(verb, path string, body []byte, id *uint64) error
 	if err != nil {
 		return err
 	}
-	wsc.send(b)
-	return nil
+	return wsc.send(b)
 }
 
+// keepAlive pings the server periodically until the connection is closed.
 func (wsc *wsConn) keepAlive() {
+	defer close(wsc.done)
 	for {
-		err := wsc.sendRequest("GET", "/v1/keepalive", nil, nil)
+		err := wsc.sendRequest("GET", endpoints().WebsocketKeepAlive, nil, nil)
 		if err != nil {
-			log.Println(err)
+			select {
+			case <-wsc.closed:
+			default:
+				log.Println(err)
+			}
+			return
+		}
+		select {
+		case <-wsc.closed:
+			return
+		case <-clock().After(time.Second * 15):
 		}
-		time.Sleep(time.Second * 15)
 	}
 }
 
@@ -147,8 +192,7 @@ func (wsc *wsConn) sendAck(id uint64) error {
 	if err != nil {
 		return err
 	}
-	wsc.send(b)
-	return nil
+	return wsc.send(b)
 }
 
 func (wsc *wsConn) get(url string) (*response, error) {
@@ -164,21 +208,153 @@ func (wsc *wsConn) put(url string, body []byte) (*response, error) {
 	return nil, nil
 }
 
+// isTimeout reports whether err was caused by an expired read deadline.
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+// Paths of the requests the server sends over the websocket.
+// Older servers send messages without a path.
+const (
+	wsMessagePath    = "/api/v1/message"
+	wsQueueEmptyPath = "/api/v1/queue/empty"
+)
+
+// ErrConnectionClosed is returned by ListenForMessages when the server refuses
+// the websocket connection, for example because the account was registered
+// on another device. Connections dropped otherwise, as when the server
+// restarts, are reestablished.
+var ErrConnectionClosed = errors.New("Websocket connection refused by the server")
+
+// isRefused reports whether the server rejected the websocket handshake,
+// which it does for credentials which are no longer valid.
+func isRefused(err error) bool {
+	de, ok := err.(*websocket.DialError)
+	return ok && de.Err == websocket.ErrBadStatus
+}
+
+// handleWSRequest handles a request sent by the server over the websocket.
+// Only message requests carry envelopes, other paths are control requests.
+func handleWSRequest(req *textsecure.WebSocketRequestMessage) error {
+	switch req.GetPath() {
+	case wsMessagePath, "":
+		m := req.GetBody()
+		if !conf().rawWebsocketBodies() {
+			var err error
+			m, err = base64.StdEncoding.DecodeString(string(m))
+			if err != nil {
+				return fmt.Errorf("WebSocketMessageRequest decode: %s", err)
+			}
+		}
+		return handleReceivedMessage(m)
+	case wsQueueEmptyPath:
+		if client.QueueEmptyHandler != nil {
+			client.QueueEmptyHandler()
+		}
+		return nil
+	default:
+		log.Printf("Ignoring websocket request %s %s\n", req.GetVerb(), req.GetPath())
+		return nil
+	}
+}
+
 // ListenForMessages connects to the server and handles incoming websocket messages.
+// If Config.IdleTimeout is set, it disconnects and returns nil after that many seconds
+// without incoming messages, and Poll or ListenForMessages can be used to fetch new ones later.
+// It returns ErrConnectionClosed if the server refuses the connection.
+// When the connection drops or fails otherwise it reconnects with a growing, jittered delay,
+// giving up after Config.MaxReconnectAttempts consecutive failed attempts if it is set.
 func ListenForMessages() error {
-	wsc, err := newWSConn(config.Server+"/v1/websocket", config.Tel, registrationInfo.password, config.SkipTLSCheck, config.Fingerprint)
+	wsc, err := connectWebsocket()
+	if isRefused(err) {
+		return ErrConnectionClosed
+	}
 	if err != nil {
 		return fmt.Errorf("Could not establish websocket connection: %s\n", err)
 	}
+	for {
+		err = wsc.listen()
+		wsc.close()
+		if err == nil {
+			return nil
+		}
+		log.Println(err)
+		for attempt := 1; ; attempt++ {
+			if conf().MaxReconnectAttempts > 0 && attempt > conf().MaxReconnectAttempts {
+				return fmt.Errorf("Could not reconnect after %d attempts: %s", conf().MaxReconnectAttempts, err)
+			}
+			clock().Sleep(reconnectDelay(attempt))
+			wsc, err = connectWebsocket()
+			if isRefused(err) {
+				return ErrConnectionClosed
+			}
+			if err == nil {
+				break
+			}
+			log.Println(err)
+		}
+	}
+}
 
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// reconnectDelay returns how long to wait before the given reconnection attempt.
+// The delay doubles with each attempt up to a maximum, and is randomized
+// so that clients disconnected together do not all reconnect at once.
+func reconnectDelay(attempt int) time.Duration {
+	d := maxReconnectDelay
+	if attempt < 7 {
+		d = minReconnectDelay << uint(attempt-1)
+		if d > maxReconnectDelay {
+			d = maxReconnectDelay
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// connectWebsocket opens the websocket connection to the server.
+func connectWebsocket() (*wsConn, error) {
+	wsc, err := newWSConn(conf().Server+endpoints().Websocket, "", conf().Tel, registrationInfo.password, conf().SkipTLSCheck, conf().Fingerprint)
+	for i := 0; err != nil && i < len(conf().AlternateHosts); i++ {
+		log.Printf("Could not connect the websocket: %s\n", err)
+		a := &conf().AlternateHosts[i]
+		wsc, err = newWSConn(a.websocketURL(), a.frontAddr(), conf().Tel, registrationInfo.password, conf().SkipTLSCheck, a.Fingerprint)
+	}
+	if err != nil {
+		return nil, err
+	}
+	metrics().IncCounter(MetricWebsocketConnects)
+	activeWS.Lock()
+	activeWS.wsc = wsc
+	activeWS.Unlock()
 	go wsc.keepAlive()
+	return wsc, nil
+}
+
+// listen handles incoming websocket messages until the connection fails or idles out.
+func (wsc *wsConn) listen() error {
+	idle := time.Duration(conf().IdleTimeout) * time.Second
+	lastActive := time.Now()
 
 	for {
+		if idle > 0 {
+			wsc.conn.SetReadDeadline(lastActive.Add(idle))
+		}
 		bmsg, err := wsc.receive()
 		if err != nil {
-			log.Println(err)
-			time.Sleep(3 * time.Second)
-			continue
+			if idle > 0 && isTimeout(err) {
+				log.Println("Websocket idle, disconnecting")
+				return nil
+			}
+			metrics().IncCounter(MetricWebsocketErrors)
+			if err == io.EOF {
+				return errors.New("Websocket connection closed")
+			}
+			return err
 		}
 
 		wsm := &textsecure.WebSocketMessage{}
@@ -187,27 +363,14 @@ func ListenForMessages() error {
 			log.Println(err)
 			continue
 		}
-		if config.Server == "https://textsecure-service-staging.whispersystems.org:443" {
-			m := wsm.GetRequest().GetBody()
-
-			err = handleReceivedMessage(m)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-
-		} else {
-			m, err := base64.StdEncoding.DecodeString(string(wsm.GetRequest().GetBody()))
-			if err != nil {
-				log.Println("WebSocketMessageRequest decode", err)
-				continue
-
-				err = handleReceivedMessage(m)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-			}
+		if wsm.GetType() != textsecure.WebSocketMessage_REQUEST {
+			continue
+		}
+		lastActive = time.Now()
+		err = handleWSRequest(wsm.GetRequest())
+		if err != nil {
+			log.Println(err)
+			continue
 		}
 		err = wsc.sendAck(wsm.GetRequest().GetId())
 		if err != nil {